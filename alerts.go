@@ -0,0 +1,371 @@
+package main
+
+/* Alert rules and hooks.
+* A rule is a threshold on a metric of the current sample, evaluated every ruleTick whatever the display interval,
+* eg: "exitrate > 500 for 30s" or "cpu:grep > 20".
+* When a rule fires (its condition held for the hold duration) or clears, every hook is called with the offending command,
+* its ancestry and the current rates. The syslog and journald sinks get them too.
+* The alerts are delivered in order by their own goroutine so a slow hook never holds displayMu.
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ruleTick = time.Second         // rules evaluation period.
+const hookTimeout = 10 * time.Second // a shell hook still running after this is killed.
+
+// Rule metrics.
+const (
+	mExitRate = "exitrate" // exits per second.
+	mSLCPU    = "slcpu"    // cpu percent used by short lived processes.
+	mCPU      = "cpu"      // cpu percent used by a command (cpu:[command]).
+	mRate     = "rate"     // executions per second of a command (rate:[command]).
+)
+
+type rule struct {
+	text   string
+	metric string
+	cmd    string // command of the cpu and rate metrics.
+	op     byte   // '>' or '<'
+	limit  float64
+	hold   time.Duration // the condition must hold this long before the rule fires.
+	since  time.Time     // first report where the condition was true (zero if it is false).
+	firing bool
+}
+
+// alert is what the hooks get when a rule fires or clears.
+type alert struct {
+	Rule       string    `json:"rule"`
+	State      string    `json:"state"` // fire or clear
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Value      float64   `json:"value"`
+	Limit      float64   `json:"limit"`
+	Command    string    `json:"command"`
+	Ancestry   []string  `json:"ancestry"` // parents of the last instance of the command: "cmd[pid]", closest first.
+	ExitRate   float64   `json:"exit_rate"`
+	CPUPercent float64   `json:"cpu_percent"` // command cpu.
+	ExecRate   float64   `json:"exec_rate"`   // command executions per second.
+}
+
+var rules ruleList
+var alertFired bool // true once a rule fired (tells the exit status of a bounded run).
+var hooks stringList
+
+// notice is an alert to deliver and the hooks when it happened (a reload may change them).
+type notice struct {
+	a     alert
+	hooks stringList
+}
+
+var notices = make(chan notice, 256)
+var noticesWG sync.WaitGroup // notices queued or being delivered.
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// ruleList is a flag that can be repeated, every value is parsed as a rule.
+type ruleList []*rule
+
+func (l *ruleList) String() string {
+	var a []string
+	for _, r := range *l {
+		a = append(a, r.text)
+	}
+	return strings.Join(a, ", ")
+}
+
+func (l *ruleList) Set(s string) error {
+	r, err := parseRule(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// parseRule parses "[metric] [>|<] [value] [for duration]" where metric is exitrate, slcpu, cpu:[command] or rate:[command].
+// The value may end with % or /s for readability.
+func parseRule(s string) (*rule, error) {
+	r := &rule{text: s}
+	t := s
+	if i := strings.Index(t, " for "); i >= 0 {
+		d, err := time.ParseDuration(strings.TrimSpace(t[i+5:]))
+		if err != nil {
+			return nil, fmt.Errorf("bad duration in rule '%s': %s", s, err)
+		}
+		r.hold = d
+		t = t[:i]
+	}
+	i := strings.IndexAny(t, "<>")
+	if i < 0 {
+		return nil, fmt.Errorf("no > or < in rule '%s'", s)
+	}
+	r.op = t[i]
+	v := strings.TrimSpace(t[i+1:])
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "/s"), "%")
+	var err error
+	if r.limit, err = strconv.ParseFloat(v, 64); err != nil {
+		return nil, fmt.Errorf("bad value in rule '%s': %s", s, err)
+	}
+	m := strings.TrimSpace(t[:i])
+	switch {
+	case m == mExitRate || m == mSLCPU:
+		r.metric = m
+	case strings.HasPrefix(m, mCPU+":"):
+		r.metric, r.cmd = mCPU, m[len(mCPU)+1:]
+	case strings.HasPrefix(m, mRate+":"):
+		r.metric, r.cmd = mRate, m[len(mRate)+1:]
+	default:
+		return nil, fmt.Errorf("unknown metric '%s' in rule '%s'. Use exitrate, slcpu, cpu:[command] or rate:[command].", m, s)
+	}
+	if (r.metric == mCPU || r.metric == mRate) && r.cmd == "" {
+		return nil, fmt.Errorf("no command in rule '%s'", s)
+	}
+	return r, nil
+}
+
+// findCmd returns the counters of command cmd in r (nil if it did not run in the sample).
+func findCmd(r *report, cmd string) *cmdInfo {
+	for j := range r.cmds {
+		if r.cmds[j].cmd == cmd {
+			return &r.cmds[j]
+		}
+	}
+	return nil
+}
+
+// topCmd returns the command with the biggest v in r (nil if none).
+func topCmd(r *report, v func(ci *cmdInfo) uint64) *cmdInfo {
+	var best *cmdInfo
+	for j := range r.cmds {
+		if ci := &r.cmds[j]; v(ci) != 0 && (best == nil || v(ci) > v(best)) {
+			best = ci
+		}
+	}
+	return best
+}
+
+// metricValue returns the value of metric (for command cmd if need be) in report r and the command behind it.
+// dts is the sample duration in s.
+func metricValue(r *report, metric, cmd string, dts float64) (float64, *cmdInfo) {
+	dtus := dts * 1e6
+	switch metric {
+	case mExitRate:
+		return float64(r.exitCount) / dts, topCmd(r, func(ci *cmdInfo) uint64 { return ci.ec })
+	case mSLCPU:
+		_, slet := lifetimeShares(r)
+		return float64(cpuPercent(float64(slet), dtus)), topCmd(r, func(ci *cmdInfo) uint64 { return ci.slet })
+	case mCPU:
+		ci := findCmd(r, cmd)
+		if ci == nil {
+			return 0, nil
+		}
+		return float64(cpuPercent(float64(ci.et), dtus)), ci
+	case mRate:
+		ci := findCmd(r, cmd)
+		if ci == nil {
+			return 0, nil
+		}
+		return float64(ci.ec) / dts, ci
+	}
+	return 0, nil
+}
+
+// tickRules evaluates the rules on the current sample every ruleTick.
+func tickRules() {
+	ticker := time.NewTicker(ruleTick)
+	for range ticker.C {
+		displayMu.Lock()
+		n := len(rules)
+		displayMu.Unlock()
+		if n == 0 {
+			continue
+		}
+		r := peekReport()
+		dts := r.time.Sub(r.sampleStart).Seconds()
+		if dts < ruleTick.Seconds() {
+			continue // The sample just started (-c), its rates are not meaningful yet.
+		}
+		displayMu.Lock()
+		checkRules(r, dts)
+		displayMu.Unlock()
+	}
+}
+
+// checkRules evaluates all the rules on report r and queues the alerts of the rules that fire or clear.
+// displayMu must be held.
+func checkRules(r *report, dts float64) {
+	now := time.Now()
+	for _, ru := range rules {
+		v, ci := metricValue(r, ru.metric, ru.cmd, dts)
+		cond := (ru.op == '>' && v > ru.limit) || (ru.op == '<' && v < ru.limit)
+		var state string
+		switch {
+		case cond && ru.since.IsZero():
+			ru.since = now
+			fallthrough
+		case cond:
+			if !ru.firing && now.Sub(ru.since) >= ru.hold {
+				ru.firing = true
+				alertFired = true
+				state = "fire"
+			}
+		default:
+			ru.since = time.Time{}
+			if ru.firing {
+				ru.firing = false
+				state = "clear"
+			}
+		}
+		if state == "" {
+			continue
+		}
+		a := alert{Rule: ru.text, State: state, Time: now, Value: v, Limit: ru.limit, ExitRate: float64(r.exitCount) / dts}
+		a.Host, _ = os.Hostname()
+		a.Command = ru.cmd
+		if ci != nil {
+			a.Command = ci.cmd
+			a.Ancestry = r.ancestry[ci.cmd]
+			a.CPUPercent = float64(cpuPercent(float64(ci.et), dts*1e6))
+			a.ExecRate = float64(ci.ec) / dts
+		}
+		noticesWG.Add(1)
+		select {
+		case notices <- notice{a, hooks}:
+		default:
+			noticesWG.Done()
+			fmt.Fprintf(os.Stderr, "Error: alert '%s' %s dropped, the hooks are too slow.\n", a.Rule, a.State)
+		}
+	}
+}
+
+// deliverAlerts calls the hooks and the alert sinks for every queued alert, in order.
+func deliverAlerts() {
+	for n := range notices {
+		for _, h := range n.hooks {
+			runHook(h, &n.a)
+		}
+		for _, as := range alertSinks {
+			if err := as.Alert(&n.a); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: alert sink: %s\n", err)
+			}
+		}
+		noticesWG.Done()
+	}
+}
+
+// flushAlerts waits (at most d) for the queued alerts to be delivered. displayMu must be held (no new alert).
+func flushAlerts(d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		noticesWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+	}
+}
+
+// runHook sends a to hook h: "file:[path]" appends a JSON line to a file, "unix:[path]" writes a JSON line to a unix socket
+// and anything else is a shell command run with TOPFAST_* environment variables and the JSON on its stdin.
+func runHook(h string, a *alert) {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false) // Keep the rules readable (> and <).
+	e.Encode(a)            // Ends with a new line.
+	js := b.Bytes()
+	var err error
+	switch {
+	case strings.HasPrefix(h, "file:"):
+		var f *os.File
+		if f, err = os.OpenFile(h[5:], os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+			_, err = f.Write(js)
+			f.Close()
+		}
+	case strings.HasPrefix(h, "unix:"):
+		var c net.Conn
+		if c, err = net.DialTimeout("unix", h[5:], time.Second); err == nil {
+			c.SetWriteDeadline(time.Now().Add(time.Second))
+			_, err = c.Write(js)
+			c.Close()
+		}
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h)
+		cmd.Stdin = bytes.NewReader(js)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		cmd.Env = append(os.Environ(),
+			"TOPFAST_RULE="+a.Rule,
+			"TOPFAST_STATE="+a.State,
+			"TOPFAST_VALUE="+strconv.FormatFloat(a.Value, 'f', 2, 64),
+			"TOPFAST_LIMIT="+strconv.FormatFloat(a.Limit, 'f', 2, 64),
+			"TOPFAST_COMMAND="+a.Command,
+			"TOPFAST_ANCESTRY="+strings.Join(a.Ancestry, " "),
+			"TOPFAST_EXIT_RATE="+strconv.FormatFloat(a.ExitRate, 'f', 2, 64),
+			"TOPFAST_CPU_PERCENT="+strconv.FormatFloat(a.CPUPercent, 'f', 2, 64),
+			"TOPFAST_EXEC_RATE="+strconv.FormatFloat(a.ExecRate, 'f', 2, 64))
+		err = cmd.Run()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: alert hook '%s': %s\n", h, err)
+	}
+}
+
+// procAncestry returns the parents of process pid ("cmd[pid]", closest first). Runs in the aggregator.
+func procAncestry(pid int) []string {
+	return ancestryOf(procInfos[pid])
+}
+
+// ancestryOf returns pi and its parents ("cmd[pid]", closest first). Runs in the aggregator.
+func ancestryOf(pi *procInfo) []string {
+	var a []string
+	for d := 0; pi != nil && d < 32; d++ {
+		cmd := "(vanished)"
+		if pi.ci != nil {
+			cmd = pi.ci.cmd
+		} else if pi.comm != "" {
+			cmd = pi.comm
+		}
+		a = append(a, fmt.Sprintf("%s[%d]", cmd, pi.pid))
+		if pi.ppi != nil {
+			pi = pi.ppi
+		} else if pi.ppid > 1 {
+			pi = procInfos[pi.ppid]
+		} else {
+			pi = nil
+		}
+	}
+	return a
+}
+
+// cmdAncestries returns the ancestry of the last instance of every command in the current sample. Runs in the aggregator.
+func cmdAncestries() map[string][]string {
+	m := make(map[string][]string, len(cmdInfos))
+	for cmd, ci := range cmdInfos {
+		m[cmd] = procAncestry(ci.ppid)
+	}
+	return m
+}
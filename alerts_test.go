@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		text   string
+		metric string
+		cmd    string
+		op     byte
+		limit  float64
+		hold   time.Duration
+		err    string // expected error prefix.
+	}{
+		{"exitrate > 100", mExitRate, "", '>', 100, 0, ""},
+		{"exitrate>100/s", mExitRate, "", '>', 100, 0, ""},
+		{"slcpu > 50% for 30s", mSLCPU, "", '>', 50, 30 * time.Second, ""},
+		{"cpu:sed > 12.5%", mCPU, "sed", '>', 12.5, 0, ""},
+		{"rate:sed < 1 for 1m", mRate, "sed", '<', 1, time.Minute, ""},
+		{"cpu:kworker/0:1 > 5", mCPU, "kworker/0:1", '>', 5, 0, ""},
+		{"exitrate = 100", "", "", 0, 0, 0, "no > or < in rule"},
+		{"exitrate > 100 for ever", "", "", 0, 0, 0, "bad duration in rule"},
+		{"exitrate > lots", "", "", 0, 0, 0, "bad value in rule"},
+		{"load > 2", "", "", 0, 0, 0, "unknown metric 'load'"},
+		{"cpu > 2", "", "", 0, 0, 0, "unknown metric 'cpu'"},
+		{"cpu: > 2", "", "", 0, 0, 0, "no command in rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			r, err := parseRule(tt.text)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Errorf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.text != tt.text || r.metric != tt.metric || r.cmd != tt.cmd || r.op != tt.op || r.limit != tt.limit || r.hold != tt.hold {
+				t.Errorf("%+v, want %s %s %c %g for %s", *r, tt.metric, tt.cmd, tt.op, tt.limit, tt.hold)
+			}
+		})
+	}
+}
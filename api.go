@@ -0,0 +1,246 @@
+package main
+
+/* HTTP JSON API (-l).
+* GET  /api/commands?sort=time|count&top=N  the by command table.
+* GET  /api/subtree?sort=time|count&top=N   the commands with their subprocesses.
+* GET  /api/histogram                       the exec time histogram of the exited processes.
+* GET  /api/tree                            the live process tree (all the known processes).
+* GET  /api/report                          the full report (the json format).
+* GET  /api/status                          counters and health (503 when no exit events can be received anymore).
+* POST /api/reset                           reset the counters.
+* GET  /api/events and /                    the web dashboard (see dashboard.go).
+* The filters (-f) apply, sort and top default to the display ones.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var httpAddr string // HTTP API listen address ("" for none).
+
+var sortNames = [2]string{scCount: "count", scTime: "time"} // sort query parameter values.
+
+// jsonSub is a command and its subprocesses in the json format.
+type jsonSub struct {
+	Command    string  `json:"command"`
+	SubET      uint64  `json:"subet_us"`
+	SubEC      uint64  `json:"subec"`
+	CPUPercent float32 `json:"cpu_percent"`
+	ExecRate   float64 `json:"exec_rate"`
+}
+
+// jsonBucket is a bucket of the exec time histogram: the processes that used from MinUS (included) to MaxUS us.
+type jsonBucket struct {
+	MinUS uint64 `json:"min_us"`
+	MaxUS uint64 `json:"max_us"`
+	Count uint64 `json:"count"`
+}
+
+// jsonNode is a process of the live tree.
+type jsonNode struct {
+	PID      int         `json:"pid"`
+	PPID     int         `json:"ppid"`
+	Cmd      string      `json:"command"`
+	ET       uint64      `json:"et_us"`
+	EC       uint64      `json:"ec"`
+	SubET    uint64      `json:"subet_us"`
+	SubEC    uint64      `json:"subec"`
+	Children []*jsonNode `json:"children,omitempty"`
+}
+
+// listenHTTP starts the HTTP API server on addr.
+func listenHTTP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("http: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/commands", apiCommands)
+	mux.HandleFunc("/api/subtree", apiSubtree)
+	mux.HandleFunc("/api/histogram", apiHistogram)
+	mux.HandleFunc("/api/tree", apiTree)
+	mux.HandleFunc("/api/report", apiReport)
+	mux.HandleFunc("/api/status", apiStatus)
+	mux.HandleFunc("/api/reset", apiReset)
+	mux.HandleFunc("/api/events", apiEvents)
+	mux.HandleFunc("/", dashboard)
+	go func() {
+		fmt.Fprintf(os.Stderr, "Error: http: %s\n", http.Serve(l, mux))
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// sortTop returns the sort criteria and top of the sort and top query parameters (default to the display ones).
+func sortTop(req *http.Request) (int, int, error) {
+	displayMu.Lock()
+	sc, n := sortCriteria, top
+	displayMu.Unlock()
+	switch s := req.URL.Query().Get("sort"); s {
+	case "":
+	case "count":
+		sc = scCount
+	case "time":
+		sc = scTime
+	default:
+		return 0, 0, fmt.Errorf("unknown sort criteria '%s'", s)
+	}
+	if s := req.URL.Query().Get("top"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("bad top '%s'", s)
+		}
+	}
+	return sc, n, nil
+}
+
+func apiCommands(w http.ResponseWriter, req *http.Request) {
+	sc, n, err := sortTop(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r := peekReport()
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	cmds := []jsonCmd{}
+	for _, ci := range sortedCmdsBy(r, cmdKey(sc, false)) {
+		if len(cmds) == n {
+			break
+		}
+		cmds = append(cmds, newJSONCmd(ci, dts))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"time": r.time, "duration_s": dts, "sort": sortNames[sc], "commands": cmds})
+}
+
+func apiSubtree(w http.ResponseWriter, req *http.Request) {
+	sc, n, err := sortTop(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r := peekReport()
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	subs := []jsonSub{}
+	for _, ci := range sortedCmdsBy(r, cmdKey(sc, true)) {
+		if len(subs) == n || ci.subec == 0 {
+			break
+		}
+		subs = append(subs, jsonSub{ci.cmd, ci.subet, ci.subec, cpuPercent(float64(ci.subet), dts*1e6), float64(ci.subec) / dts})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"time": r.time, "duration_s": dts, "sort": sortNames[sc], "commands": subs})
+}
+
+// histBuckets returns the exec time histogram of r up to its last non empty bucket.
+func histBuckets(r *report) []jsonBucket {
+	last := -1
+	for i, c := range r.ehist {
+		if c != 0 {
+			last = i
+		}
+	}
+	bs := []jsonBucket{}
+	lo, hi := uint64(0), uint64(10)
+	for i := 0; i <= last; i++ {
+		bs = append(bs, jsonBucket{lo, hi, r.ehist[i]})
+		lo, hi = hi, hi*10
+	}
+	return bs
+}
+
+func apiHistogram(w http.ResponseWriter, req *http.Request) {
+	r := peekReport()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"time": r.time, "duration_s": r.time.Sub(r.sampleStart).Seconds(), "buckets": histBuckets(r)})
+}
+
+func apiTree(w http.ResponseWriter, req *http.Request) {
+	rc := make(chan *report)
+	aggReqs <- aggReq{op: aggTree, reply: rc}
+	r := <-rc
+	ns := make([]jsonNode, len(r.procs))
+	roots := []*jsonNode{}
+	for i, n := range r.procs {
+		ns[i] = jsonNode{PID: n.pid, PPID: n.ppid, Cmd: n.cmd, ET: n.et, EC: n.ec, SubET: n.subet, SubEC: n.subec}
+	}
+	for i, n := range r.procs {
+		if n.parent < 0 {
+			roots = append(roots, &ns[i])
+		} else {
+			p := &ns[n.parent]
+			p.Children = append(p.Children, &ns[i])
+		}
+	}
+	var sortNodes func(l []*jsonNode)
+	sortNodes = func(l []*jsonNode) {
+		sort.Slice(l, func(a, b int) bool { return l[a].PID < l[b].PID })
+		for _, n := range l {
+			sortNodes(n.Children)
+		}
+	}
+	sortNodes(roots)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"time": r.time, "processes": len(ns), "tree": roots})
+}
+
+func apiReport(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, jsonReport(peekReport()))
+}
+
+func apiStatus(w http.ResponseWriter, req *http.Request) {
+	r := peekReport()
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	var drops uint64
+	for _, c := range exitConns {
+		d, _ := netlinkDrops(c.Inode())
+		drops += d
+	}
+	displayMu.Lock()
+	displays := display
+	displayMu.Unlock()
+	st := map[string]interface{}{
+		"status":         "ok",
+		"pid":            os.Getpid(),
+		"started":        sessionStart,
+		"uptime_s":       time.Since(sessionStart).Seconds(),
+		"sample_start":   r.sampleStart,
+		"displays":       displays,
+		"exit_count":     r.exitCount,
+		"exit_rate":      float64(r.exitCount) / dts,
+		"commands":       len(r.cmds),
+		"pid_reuses":     r.reusedCount,
+		"netlink_drops":  drops,
+		"overflows":      atomic.LoadInt64(&exitOverflows),
+		"queue_drops":    atomic.LoadUint64(&evqDrops),
+		"exit_listeners": atomic.LoadInt64(&exitListeners),
+	}
+	code := http.StatusOK
+	if atomic.LoadInt64(&exitListeners) == 0 {
+		st["status"] = "error"
+		if err := exitError(); err != nil {
+			st["error"] = err.Error()
+		}
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, st)
+}
+
+func apiReset(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	clearCounters()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
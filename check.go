@@ -0,0 +1,109 @@
+package main
+
+/* Check mode: topfast as a Nagios/Icinga plugin.
+* Sample for a given duration, evaluate the warning and critical thresholds, print one status line with perfdata and exit
+* with the plugin status.
+ */
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Plugin exit status.
+const (
+	checkOK = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+var checkNames = [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+var checkDur time.Duration // check mode sampling duration (0 when not in check mode).
+var warnRules, critRules ruleList
+
+// runCheck samples for checkDur, prints the plugin status line and exits.
+func runCheck() {
+	go func() {
+		check(aggregate(group))
+	}()
+	time.Sleep(checkDur)
+	rc := make(chan *report)
+	aggReqs <- aggReq{op: aggStats, reply: rc}
+	r := <-rc
+	dts := time.Since(r.sampleStart).Seconds()
+	status := checkOK
+	var msgs []string
+	for _, t := range []struct {
+		rules  ruleList
+		status int
+	}{{critRules, checkCritical}, {warnRules, checkWarning}} {
+		for _, ru := range t.rules {
+			v, ci := metricValue(r, ru.metric, ru.cmd, dts)
+			if (ru.op == '>' && v > ru.limit) || (ru.op == '<' && v < ru.limit) {
+				status = max(status, t.status)
+				m := fmt.Sprintf("%s (%.2f)", ru.text, v)
+				if ci != nil && ru.cmd == "" {
+					m += fmt.Sprintf(" top command %s", ci.cmd)
+				}
+				msgs = append(msgs, m)
+			}
+		}
+	}
+	ev, _ := metricValue(r, mExitRate, "", dts)
+	sv, _ := metricValue(r, mSLCPU, "", dts)
+	if len(msgs) == 0 {
+		msgs = append(msgs, fmt.Sprintf("short lived cpu %.2f%%, exit rate %.2f/s", sv, ev))
+	}
+	fmt.Printf("TOPFAST %s - %s | %s\n", checkNames[status], strings.Join(msgs, ", "), perfData(r, dts)) // stdout whatever -o, the plugin contract.
+	os.Exit(status)
+}
+
+// perfData returns the plugin performance data: exitrate, slcpu and the metrics of all the thresholds.
+func perfData(r *report, dts float64) string {
+	type metric struct{ name, cmd string }
+	ms := []metric{{mExitRate, ""}, {mSLCPU, ""}}
+	for _, ru := range append(append(ruleList{}, warnRules...), critRules...) {
+		m := metric{ru.metric, ru.cmd}
+		known := false
+		for _, k := range ms {
+			known = known || k == m
+		}
+		if !known {
+			ms = append(ms, m)
+		}
+	}
+	var pd []string
+	for _, m := range ms {
+		v, _ := metricValue(r, m.name, m.cmd, dts)
+		label, uom := m.name, ""
+		if m.cmd != "" {
+			label += "_" + m.cmd
+		}
+		if m.name == mSLCPU || m.name == mCPU {
+			uom = "%"
+		}
+		if strings.ContainsAny(label, " '=") {
+			label = "'" + strings.Replace(label, "'", "''", -1) + "'"
+		}
+		pd = append(pd, fmt.Sprintf("%s=%.2f%s;%s;%s;;", label, v, uom, perfRange(warnRules, m.name, m.cmd), perfRange(critRules, m.name, m.cmd)))
+	}
+	return strings.Join(pd, " ")
+}
+
+// perfRange returns the perfdata threshold range of the first rule about metric (empty if none).
+// "10" alerts over 10 and "10:" under 10.
+func perfRange(rs ruleList, metric, cmd string) string {
+	for _, ru := range rs {
+		if ru.metric == metric && ru.cmd == cmd {
+			if ru.op == '<' {
+				return fmt.Sprintf("%g:", ru.limit)
+			}
+			return fmt.Sprintf("%g", ru.limit)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,299 @@
+package main
+
+/* Configuration file.
+* A JSON object whose keys name the command line options (see cfgKeys). The command line wins over the file.
+* SIGHUP reloads the file: the counters are kept, only the display, output, filters, groups and alert settings change.
+* A key removed from the file goes back to its default. The startup only keys (eg: sinks) need a restart, a warning tells
+* when they changed.
+* eg: {"interval": "10m", "clear": true, "top": 20, "filters": ["^php"], "groups": {"php": "^php"}, "rules": ["exitrate > 500 for 30s"]}
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cfgPath string
+var cmdline = map[string]bool{} // flags set on the command line.
+
+// Configuration keys and their flag.
+var cfgKeys = map[string]string{
+	"interval":   "i",
+	"sort":       "s",
+	"top":        "t",
+	"clear":      "c",
+	"raw":        "r",
+	"format":     "format",
+	"columns":    "cols",
+	"histogram":  "H",
+	"tree":       "T",
+	"parents":    "P",
+	"output":     "o",
+	"sinks":      "O",
+	"rotate":     "R",
+	"keep":       "k",
+	"filters":    "f",
+	"groups":     "G",
+	"rules":      "a",
+	"hooks":      "x",
+	"daemon":     "D",
+	"pidfile":    "p",
+	"control":    "S",
+	"ancestry":   "A",
+	"exit_group": "g",
+	"rcvbuf":     "b",
+	"events":     "e",
+	"http":       "l",
+}
+
+// Flags only read at startup, a reload ignores them.
+var cfgStartOnly = map[string]bool{"O": true, "D": true, "p": true, "S": true, "A": true, "g": true, "b": true, "e": true, "l": true}
+
+var cfgStart = map[string]interface{}{} // values of the startup only keys in the file at startup.
+
+// cmdGroup merges the commands matching re in a single command name.
+type cmdGroup struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// groupList is a flag that can be repeated, every value is "[name]=[regexp]".
+type groupList []cmdGroup
+
+var groups groupList // command grouping rules (options side, the aggregator has its own copy).
+
+func (l *groupList) String() string {
+	var a []string
+	for _, g := range *l {
+		a = append(a, g.name+"="+g.re.String())
+	}
+	return strings.Join(a, " ")
+}
+
+func (l *groupList) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("bad group '%s', use [name]=[regexp]", s)
+	}
+	re, err := regexp.Compile(s[i+1:])
+	if err != nil {
+		return err
+	}
+	*l = append(*l, cmdGroup{s[:i], re})
+	return nil
+}
+
+// Aggregator side of the grouping rules.
+var cmdGroups groupList
+var groupCache = map[string]string{}
+
+// groupOf returns the name under which command cmd is counted (its group if it matches one). Runs in the aggregator.
+func groupOf(cmd string) string {
+	if len(cmdGroups) == 0 {
+		return cmd
+	}
+	if g, known := groupCache[cmd]; known {
+		return g
+	}
+	g := cmd
+	for _, cg := range cmdGroups {
+		if cg.re.MatchString(cmd) {
+			g = cg.name
+			break
+		}
+	}
+	groupCache[cmd] = g
+	return g
+}
+
+// setGroups replaces the grouping rules. Runs in the aggregator.
+func setGroups(gs groupList) {
+	cmdGroups = gs
+	groupCache = map[string]string{}
+}
+
+// newAggOptions returns the aggregator copy of the options. displayMu must be held once the aggregator runs.
+func newAggOptions() aggOptions {
+	return aggOptions{clear: clear, hist: hist, tree: tree, parents: parents, alerts: len(rules) != 0}
+}
+
+// loadConfig reads the configuration file and sets the flags it holds (but the command line ones).
+// At startup (start true) all flags are set, on reload the startup only ones are ignored.
+func loadConfig(path string, start bool) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg map[string]interface{}
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("config %s: %s", path, err)
+	}
+	var keys []string
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// Check everything before changing anything.
+	for _, k := range keys {
+		if _, known := cfgKeys[k]; !known {
+			return fmt.Errorf("config %s: unknown key '%s'", path, k)
+		}
+	}
+	if !start {
+		for k, name := range cfgKeys {
+			if _, set := cfg[k]; set || cmdline[name] || cfgStartOnly[name] {
+				continue
+			}
+			// Removed from the file: back to the default.
+			if !resetList(name) {
+				flag.Set(name, flag.Lookup(name).DefValue)
+			}
+		}
+	}
+	for _, k := range keys {
+		name := cfgKeys[k]
+		if cfgStartOnly[name] {
+			if start {
+				cfgStart[k] = cfg[k]
+			} else if !cmdline[name] && !reflect.DeepEqual(cfg[k], cfgStart[k]) {
+				fmt.Fprintf(os.Stderr, "Warning: config %s: '%s' changed, it only applies after a restart.\n", path, k)
+			}
+		}
+		if cmdline[name] || (!start && cfgStartOnly[name]) {
+			continue
+		}
+		var vals []string
+		switch v := cfg[k].(type) {
+		case []interface{}:
+			resetList(name)
+			for _, e := range v {
+				vals = append(vals, cfgString(e))
+			}
+		case map[string]interface{}:
+			resetList(name)
+			var ks []string
+			for n := range v {
+				ks = append(ks, n)
+			}
+			sort.Strings(ks)
+			for _, n := range ks {
+				vals = append(vals, n+"="+cfgString(v[n]))
+			}
+		default:
+			vals = []string{cfgString(v)}
+		}
+		for _, s := range vals {
+			if err = flag.Set(name, s); err != nil {
+				return fmt.Errorf("config %s: %s: %s", path, k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resetList empties the list behind a repeatable flag (the file replaces it). Returns false if name is not a list.
+func resetList(name string) bool {
+	switch name {
+	case "f":
+		filters = nil
+	case "G":
+		groups = nil
+	case "a":
+		rules = nil
+	case "x":
+		hooks = nil
+	case "O":
+		sinkSpecs = nil
+	default:
+		return false
+	}
+	return true
+}
+
+func cfgString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// settings are the values a reload may change (see saveSettings).
+type settings struct {
+	interval                                        time.Duration
+	sortKey, formatOpt, colsSpec, outfn, rotateSpec string
+	top, keep                                       int
+	clear, raw, hist, tree, parents                 bool
+	filters                                         filterList
+	groups                                          groupList
+	rules                                           ruleList
+	hooks                                           stringList
+	// Derived by checkOpts.
+	sortCriteria int
+	dispFormat   string
+	cols         []column
+	rotateSize   int64
+	rotateAge    time.Duration
+}
+
+func saveSettings() *settings {
+	return &settings{interval, sortKey, formatOpt, colsSpec, outfn, rotateSpec, top, keep, clear, raw, hist, tree, parents,
+		filters, groups, rules, hooks, sortCriteria, dispFormat, cols, rotateSize, rotateAge}
+}
+
+func (st *settings) restore() {
+	interval, sortKey, formatOpt, colsSpec, outfn, rotateSpec = st.interval, st.sortKey, st.formatOpt, st.colsSpec, st.outfn, st.rotateSpec
+	top, keep, clear, raw, hist, tree, parents = st.top, st.keep, st.clear, st.raw, st.hist, st.tree, st.parents
+	filters, groups, rules, hooks = st.filters, st.groups, st.rules, st.hooks
+	sortCriteria, dispFormat, cols, rotateSize, rotateAge = st.sortCriteria, st.dispFormat, st.cols, st.rotateSize, st.rotateAge
+}
+
+// reloadConfig reloads the configuration file (SIGHUP) and applies the changes. The counters are kept.
+// It is all or nothing: with a bad value anywhere in the file the previous settings are kept.
+func reloadConfig() error {
+	displayMu.Lock()
+	filtersMu.Lock()
+	old := saveSettings()
+	err := loadConfig(cfgPath, false)
+	if err == nil {
+		err = checkOpts()
+	}
+	if err == nil && outfn != old.outfn {
+		err = setOutput() // Last, it can not be undone.
+	}
+	if err != nil {
+		old.restore()
+		filtersMu.Unlock()
+		displayMu.Unlock()
+		return fmt.Errorf("%s (configuration not changed)", err)
+	}
+	// Keep the state of the rules that did not change.
+	for _, ru := range rules {
+		for _, o := range old.rules {
+			if o.text == ru.text {
+				ru.since, ru.firing = o.since, o.firing
+			}
+		}
+	}
+	req := aggReq{op: aggSettings, groups: groups, opts: newAggOptions()}
+	filtersMu.Unlock()
+	displayMu.Unlock()
+	aggReqs <- req
+	if interval != old.interval {
+		intervalCh <- interval
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags gives the test fresh flags at their default values.
+func testFlags(t *testing.T) {
+	saved, savedCmdline, savedStart := flag.CommandLine, cmdline, cfgStart
+	t.Cleanup(func() {
+		flag.CommandLine, cmdline, cfgStart = saved, savedCmdline, savedStart
+		for _, name := range []string{"f", "G", "a", "x", "O"} {
+			resetList(name)
+		}
+	})
+	flag.CommandLine = flag.NewFlagSet("topfast", flag.ContinueOnError)
+	cmdline, cfgStart = map[string]bool{}, map[string]interface{}{}
+	for _, name := range []string{"f", "G", "a", "x", "O"} {
+		resetList(name)
+	}
+	defineFlags()
+}
+
+// writeConfig writes the configuration file content to path.
+func writeConfig(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdline string // flag set on the command line (top to 5).
+		cfg     string
+		err     string // expected error, the checks of the other fields are skipped.
+		check   func() bool
+	}{
+		{"values", "", `{"interval": "10m", "top": 20, "clear": true, "sort": "count", "filters": ["^php", "^sed"], "groups": {"sh": "^(ba|da)?sh$"}, "rules": ["exitrate > 500 for 30s"]}`, "",
+			func() bool {
+				return interval == 10*time.Minute && top == 20 && clear && sortKey == "count" && len(filters) == 2 &&
+					len(groups) == 1 && groups[0].name == "sh" && len(rules) == 1 && rules[0].hold == 30*time.Second
+			}},
+		{"command line wins", "t", `{"top": 20, "histogram": true}`, "", func() bool { return top == 5 && hist }},
+		{"unknown key", "", `{"top": 20, "color": true}`, "unknown key 'color'", nil},
+		{"bad value", "", `{"top": "many"}`, "top: parse error", nil},
+		{"bad rule", "", `{"rules": ["load > 2"]}`, "rules: unknown metric", nil},
+		{"bad json", "", `{"top": 20,}`, "invalid character", nil},
+	}
+	path := filepath.Join(t.TempDir(), "topfast.json")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFlags(t)
+			if tt.cmdline != "" {
+				flag.Set(tt.cmdline, "5")
+				cmdline[tt.cmdline] = true
+			}
+			writeConfig(t, path, tt.cfg)
+			err := loadConfig(path, true)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check() {
+				t.Errorf("%s not applied: interval %s top %d clear %t hist %t sort %s filters %d groups %d rules %d",
+					tt.cfg, interval, top, clear, hist, sortKey, len(filters), len(groups), len(rules))
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	testFlags(t)
+	path := filepath.Join(t.TempDir(), "topfast.json")
+	writeConfig(t, path, `{"top": 20, "clear": true, "filters": ["^php"], "ancestry": "current", "rotate": "1M"}`)
+	if err := loadConfig(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if top != 20 || !clear || len(filters) != 1 || ancestry != "current" || rotateSpec != "1M" {
+		t.Fatalf("start: top %d clear %t filters %d ancestry %s rotate %s", top, clear, len(filters), ancestry, rotateSpec)
+	}
+	// Removed keys go back to their default, the startup only ones are kept.
+	writeConfig(t, path, `{"top": 30, "ancestry": "original"}`)
+	if err := loadConfig(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if top != 30 || clear || len(filters) != 0 || rotateSpec != "" || keep != 7 {
+		t.Errorf("reload: top %d clear %t filters %d rotate %q keep %d, want 30 false 0 \"\" 7", top, clear, len(filters), rotateSpec, keep)
+	}
+	if ancestry != "current" {
+		t.Errorf("reload: ancestry %s, want current (startup only)", ancestry)
+	}
+}
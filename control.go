@@ -0,0 +1,286 @@
+package main
+
+/* Control socket.
+* A unix domain socket (-S) accepting one command per line. Every reply ends with a line "OK" or "ERR [message]".
+* `topfast ctl [command]` is the companion client.
+ */
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSocket = "/run/topfast.sock"
+
+var ctlPath string // control socket path ("" for no control socket).
+
+var intervalCh = make(chan time.Duration) // display interval changes (for tickDisplay).
+
+const ctlHelp = `stats [format] [reset]     dump the stats in text, raw, json, csv, tsv or influx (default is the display format), reset the counters after
+reset                      reset the counters
+sort time|count            change the sort criteria
+top [n]                    change the number of lines in the top sections
+interval [duration]        change the display interval (0 to stop the periodic displays)
+filter add [regexp]        only display the commands matching one of the filters
+filter remove [regexp]     remove a filter
+filter list                list the filters
+status                     show the options and counters
+help                       this help
+`
+
+// filterList is a flag that can be repeated, every value is a command name regexp.
+type filterList []*regexp.Regexp
+
+var filters filterList // displayed commands (all if empty).
+
+// filtersMu guards filters and sortCriteria for their readers that do not hold displayMu (sinks, api, exit records).
+// The writers hold both, displayMu first.
+var filtersMu sync.RWMutex
+
+func (l *filterList) String() string {
+	var a []string
+	for _, re := range *l {
+		a = append(a, re.String())
+	}
+	return strings.Join(a, " ")
+}
+
+func (l *filterList) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+// shown tells if command cmd passes the filters.
+func shown(cmd string) bool {
+	filtersMu.RLock()
+	defer filtersMu.RUnlock()
+	return passes(cmd)
+}
+
+// passes is shown() for the callers holding filtersMu.
+func passes(cmd string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, re := range filters {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenControl creates the control socket and serves it.
+func listenControl(path string) error {
+	if err := removeStaleSocket(path); err != nil {
+		return fmt.Errorf("control socket: %s", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("control socket: %s", err)
+	}
+	os.Chmod(path, 0600)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: control socket: %s\n", err)
+				return
+			}
+			go serveControl(c)
+		}
+	}()
+	return nil
+}
+
+// removeStaleSocket removes path if it is a socket left by a previous run (nobody accepts connections on it).
+// Anything else is an error: we must not delete a random file or steal the socket of a running topfast.
+func removeStaleSocket(path string) error {
+	st, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if st.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use (another topfast is running?)", path)
+	}
+	return os.Remove(path)
+}
+
+func serveControl(c net.Conn) {
+	defer c.Close()
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		w := bufio.NewWriter(c)
+		if err := control(w, strings.Fields(s.Text())); err != nil {
+			fmt.Fprintf(w, "ERR %s\n", err)
+		} else {
+			fmt.Fprintf(w, "OK\n")
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// control runs the command args and writes its output to w.
+func control(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("empty command, try help")
+	}
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	switch args[0] {
+	case "stats":
+		format, reset := dispFormat, false
+		for _, a := range args[1:] {
+			switch {
+			case formats[a]:
+				format = a
+			case a == "reset":
+				reset = true
+			default:
+				return fmt.Errorf("unknown stats option '%s'", a)
+			}
+		}
+		return dumpStats(w, format, reset)
+	case "reset":
+		clearCounters()
+	case "sort":
+		displayMu.Lock()
+		defer displayMu.Unlock()
+		filtersMu.Lock()
+		defer filtersMu.Unlock()
+		switch arg(1) {
+		case "count":
+			sortCriteria = scCount
+		case "time":
+			sortCriteria = scTime
+		default:
+			return fmt.Errorf("unknown sort criteria '%s'", arg(1))
+		}
+	case "top":
+		n, err := strconv.Atoi(arg(1))
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad top '%s'", arg(1))
+		}
+		displayMu.Lock()
+		top = n
+		displayMu.Unlock()
+	case "interval":
+		d, err := time.ParseDuration(arg(1))
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad interval '%s'", arg(1))
+		}
+		displayMu.Lock()
+		interval = d
+		displayMu.Unlock()
+		intervalCh <- d
+	case "filter":
+		displayMu.Lock()
+		defer displayMu.Unlock()
+		filtersMu.Lock()
+		defer filtersMu.Unlock()
+		switch arg(1) {
+		case "add":
+			return filters.Set(strings.Join(args[2:], " "))
+		case "remove":
+			re := strings.Join(args[2:], " ")
+			for i := range filters {
+				if filters[i].String() == re {
+					filters = append(filters[:i], filters[i+1:]...)
+					return nil
+				}
+			}
+			return fmt.Errorf("no filter '%s'", re)
+		case "list", "":
+			for _, re := range filters {
+				fmt.Fprintf(w, "%s\n", re)
+			}
+		default:
+			return fmt.Errorf("unknown filter operation '%s'", arg(1))
+		}
+	case "status":
+		ctlStatus(w)
+	case "help":
+		fmt.Fprint(w, ctlHelp)
+	default:
+		return fmt.Errorf("unknown command '%s', try help", args[0])
+	}
+	return nil
+}
+
+func ctlStatus(w io.Writer) {
+	r := peekReport()
+	displayMu.Lock()
+	defer displayMu.Unlock()
+	fmt.Fprintf(w, "pid:            %d\n", os.Getpid())
+	fmt.Fprintf(w, "running since:  %s\n", sessionStart.Format(time.RFC3339))
+	fmt.Fprintf(w, "sample start:   %s\n", r.sampleStart.Format(time.RFC3339))
+	fmt.Fprintf(w, "displays:       %d\n", display)
+	fmt.Fprintf(w, "exit count:     %d\n", r.exitCount)
+	fmt.Fprintf(w, "commands:       %d\n", len(r.cmds))
+	fmt.Fprintf(w, "sort:           %s\n", scStrings[sortCriteria])
+	fmt.Fprintf(w, "top:            %d\n", top)
+	fmt.Fprintf(w, "interval:       %s\n", interval)
+	fmt.Fprintf(w, "clear:          %t\n", clear)
+	fmt.Fprintf(w, "filters:        %s\n", filters.String())
+	fmt.Fprintf(w, "exit listeners: %d\n", len(exitConns))
+}
+
+// ctl is the control client: topfast ctl [-S socket] [command]. Returns the exit status.
+func ctl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	path := fs.String("S", defaultSocket, "control socket of the running topfast.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl [-S socket] command\nCommands:\n%s", os.Args[0], ctlHelp)
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	c, err := net.Dial("unix", *path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "%s\n", strings.Join(fs.Args(), " "))
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		l := s.Text()
+		switch {
+		case l == "OK":
+			return 0
+		case strings.HasPrefix(l, "ERR "):
+			fmt.Fprintf(os.Stderr, "Error: %s\n", l[4:])
+			return 1
+		}
+		fmt.Println(l)
+	}
+	fmt.Fprintf(os.Stderr, "Error: connection closed before the end of the reply\n")
+	return 1
+}
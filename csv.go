@@ -0,0 +1,144 @@
+package main
+
+/* CSV and TSV formats.
+* One row per command with the chosen columns (-cols) after a header row. The fields are quoted when need be (encoding/csv)
+* so any command name is safe.
+ */
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neoliv/topfast/taskstats"
+)
+
+const defaultCols = "time,cmd,et,ec,avg,cpu,rate,p50,p90,p99,subet,subec"
+
+var colsSpec string // -cols value.
+var cols []column   // columns of the csv and tsv formats.
+
+// column is a csv column: its name and how to get its value for command ci in a report of dts seconds ending at t.
+type column struct {
+	name  string
+	value func(ci *cmdInfo, t time.Time, dts float64) string
+}
+
+func u64(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+// feature returns v as a column value, empty if this kernel does not provide the taskstats feature f (rather than 0).
+func feature(f taskstats.Feature, v uint64) string {
+	if probe != nil && !probe.Has(f) {
+		return ""
+	}
+	return u64(v)
+}
+
+func f64(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// Known columns (plus p[N] for any percentile N of the exec time).
+var columns = []column{
+	{"time", func(ci *cmdInfo, t time.Time, dts float64) string { return t.Format(time.RFC3339) }},
+	{"ts", func(ci *cmdInfo, t time.Time, dts float64) string { return strconv.FormatInt(t.Unix(), 10) }},
+	{"host", func(ci *cmdInfo, t time.Time, dts float64) string { h, _ := os.Hostname(); return h }},
+	{"cmd", func(ci *cmdInfo, t time.Time, dts float64) string { return ci.cmd }},
+	{"et", func(ci *cmdInfo, t time.Time, dts float64) string { return u64(ci.et) }},
+	{"ec", func(ci *cmdInfo, t time.Time, dts float64) string { return u64(ci.ec) }},
+	{"avg", func(ci *cmdInfo, t time.Time, dts float64) string {
+		if ci.ec == 0 {
+			return "0"
+		}
+		return u64(ci.et / ci.ec)
+	}},
+	{"cpu", func(ci *cmdInfo, t time.Time, dts float64) string {
+		return f64(float64(cpuPercent(float64(ci.et), dts*1e6)))
+	}},
+	{"rate", func(ci *cmdInfo, t time.Time, dts float64) string { return f64(float64(ci.ec) / dts) }},
+	{"subet", func(ci *cmdInfo, t time.Time, dts float64) string { return u64(ci.subet) }},
+	{"subec", func(ci *cmdInfo, t time.Time, dts float64) string { return u64(ci.subec) }},
+	{"slet", func(ci *cmdInfo, t time.Time, dts float64) string { return u64(ci.slet) }},
+	{"slec", func(ci *cmdInfo, t time.Time, dts float64) string { return u64(ci.slec) }},
+	{"uid", func(ci *cmdInfo, t time.Time, dts float64) string { return strconv.Itoa(ci.uid) }},
+	{"rss", func(ci *cmdInfo, t time.Time, dts float64) string { return feature(taskstats.Extended, ci.rss) }},
+	{"rd", func(ci *cmdInfo, t time.Time, dts float64) string { return feature(taskstats.IO, ci.rd) }},
+	{"wr", func(ci *cmdInfo, t time.Time, dts float64) string { return feature(taskstats.IO, ci.wr) }},
+}
+
+// columnNames returns the names of the known columns.
+func columnNames() string {
+	var a []string
+	for _, c := range columns {
+		a = append(a, c.name)
+	}
+	return strings.Join(a, ", ")
+}
+
+// parseCols parses a comma separated list of column names.
+func parseCols(s string) ([]column, error) {
+	var cs []column
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		c, err := findColumn(name)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func findColumn(name string) (column, error) {
+	for _, c := range columns {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	if strings.HasPrefix(name, "p") {
+		if p, err := strconv.ParseFloat(name[1:], 64); err == nil && p > 0 && p <= 100 {
+			return column{name, func(ci *cmdInfo, t time.Time, dts float64) string { return u64(ci.percentile(p)) }}, nil
+		}
+	}
+	return column{}, fmt.Errorf("Unknown column '%s'. Use %s or p[percentile] (eg: p95).", name, columnNames())
+}
+
+// needHeader tells if the header row must be written to w. n is the number of reports already written to w.
+// An output file gets one at its start only: not when appending to a non empty file, again after a reopen or a rotation.
+func needHeader(w io.Writer, n uint) bool {
+	if l, ok := w.(*logFile); ok {
+		return l.size == 0
+	}
+	return n == 0
+}
+
+// writeCSV writes the commands of r to w, comma or tab (tsv) separated. n is the number of reports already written to w
+// (see needHeader()).
+func writeCSV(w io.Writer, tsv bool, n uint, r *report) error {
+	cw := csv.NewWriter(w)
+	if tsv {
+		cw.Comma = '\t'
+	}
+	row := make([]string, len(cols))
+	if needHeader(w, n) {
+		for i, c := range cols {
+			row[i] = c.name
+		}
+		cw.Write(row)
+	}
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	for _, ci := range sortedCmds(r) {
+		for i, c := range cols {
+			row[i] = c.value(ci, r.time, dts)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
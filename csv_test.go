@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/neoliv/topfast/taskstats"
+)
+
+// setCols sets the csv columns for a test.
+func setCols(t *testing.T, spec string) {
+	saved := cols
+	t.Cleanup(func() { cols = saved })
+	var err error
+	if cols, err = parseCols(spec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	setCols(t, "cmd,et,ec")
+	tests := []struct {
+		name string
+		tsv  bool
+		cmd  string
+		want string
+	}{
+		{"plain", false, "sed", "cmd,et,ec\nsed,2000,4\n"},
+		{"comma", false, "a,b", "cmd,et,ec\n\"a,b\",2000,4\n"},
+		{"quote", false, `a"b`, "cmd,et,ec\n\"a\"\"b\",2000,4\n"},
+		{"new line", false, "a\nb", "cmd,et,ec\n\"a\nb\",2000,4\n"},
+		{"tsv", true, "a,b c", "cmd\tet\tec\na,b c\t2000\t4\n"},
+		{"tsv tab", true, "a\tb", "cmd\tet\tec\n\"a\tb\"\t2000\t4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeCSV(&b, tt.tsv, 0, testReport(cmdInfo{cmd: tt.cmd, et: 2000, ec: 4})); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("%q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	setCols(t, "cmd,ec")
+	savedSize, savedKeep := rotateSize, keep
+	defer func() { rotateSize, keep = savedSize, savedKeep }()
+	path := filepath.Join(t.TempDir(), "out.csv")
+	r := testReport(cmdInfo{cmd: "sed", ec: 4})
+	l, err := openLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(n uint) {
+		if err := writeCSV(l, false, n, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := func(p string) string {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	write(0)
+	write(1)
+	l.f.Close()
+	// A restart appends to the file: n starts from 0 again but there is a header already.
+	if l, err = openLog(path); err != nil {
+		t.Fatal(err)
+	}
+	write(0)
+	if got, want := content(path), "cmd,ec\nsed,4\nsed,4\nsed,4\n"; got != want {
+		t.Errorf("appended file %q, want %q", got, want)
+	}
+	rotateSize, keep = 1, 1
+	if err = l.rotateIfDue(); err != nil {
+		t.Fatal(err)
+	}
+	write(3)
+	l.f.Close()
+	if got, want := content(path), "cmd,ec\nsed,4\n"; got != want {
+		t.Errorf("rotated file %q, want %q", got, want)
+	}
+	if got := content(path + ".1"); strings.Count(got, "cmd,ec") != 1 {
+		t.Errorf("previous file %q, want one header", got)
+	}
+	// Other writers get it with their first report only.
+	var b bytes.Buffer
+	writeCSV(&b, false, 0, r)
+	writeCSV(&b, false, 1, r)
+	if got, want := b.String(), "cmd,ec\nsed,4\nsed,4\n"; got != want {
+		t.Errorf("%q, want %q", got, want)
+	}
+}
+
+func TestCSVFeatures(t *testing.T) {
+	setCols(t, "cmd,rss,rd,wr")
+	saved := probe
+	defer func() { probe = saved }()
+	r := testReport(cmdInfo{cmd: "sed", rss: 1024, rd: 0, wr: 4096})
+	tests := []struct {
+		name  string
+		probe *taskstats.Stats
+		want  string
+	}{
+		{"unknown", nil, "sed,1024,0,4096"},
+		{"all", &taskstats.Stats{Version: 16, Size: 1000}, "sed,1024,0,4096"},
+		{"none", &taskstats.Stats{Version: 16, Size: 8}, "sed,,,"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe = tt.probe
+			var b bytes.Buffer
+			writeCSV(&b, false, 1, r)
+			if got := strings.TrimSpace(b.String()); got != tt.want {
+				t.Errorf("%q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+/* Daemon mode and output file management.
+* -D restarts topfast detached from the terminal (new session, stdio on /dev/null or the output file).
+* The output file is appended to, reopened on SIGHUP (for logrotate) and optionally rotated at display boundaries.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const daemonEnv = "TOPFAST_DAEMON" // set in the environment of the detached process.
+
+var daemon bool
+var pidfn string      // pidfile path ("" for none).
+var rotateSpec string // -R value.
+var rotateSize int64  // rotate the output file when it reaches this size [in bytes] (0 for no limit).
+var rotateAge time.Duration
+var keep int      // number of rotated files kept.
+var outf *logFile // output file (nil if stdout).
+
+// logFile is an output file that can be reopened and rotated. Writes and rotations happen under displayMu.
+type logFile struct {
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// setOutput makes outfn the output (stdout if ""), closing the previous output file. On error the output is unchanged.
+func setOutput() error {
+	var l *logFile
+	if outfn != "" {
+		var err error
+		if l, err = openLog(outfn); err != nil {
+			return err
+		}
+	}
+	if outf != nil {
+		outf.f.Close()
+	}
+	outf = l
+	if l != nil {
+		out = l
+	} else {
+		out = os.Stdout
+	}
+	return nil
+}
+
+// openLog opens path for appending (a restart must not lose the previous reports).
+func openLog(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	return l, l.open()
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.size = 0
+	if st, err := f.Stat(); err == nil {
+		l.size = st.Size()
+	}
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// reopen closes and opens the file again, after logrotate moved it away.
+func (l *logFile) reopen() error {
+	l.f.Close()
+	return l.open()
+}
+
+// rotateIfDue rotates the file when it is too big or too old: path.1 is the newest rotated file, path.[keep] the oldest.
+func (l *logFile) rotateIfDue() error {
+	if (rotateSize == 0 || l.size < rotateSize) && (rotateAge == 0 || time.Since(l.opened) < rotateAge) {
+		return nil
+	}
+	l.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if keep > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+// parseRotate parses the -R value: a size (eg: 100M), an age (eg: 24h) or both separated by a comma.
+func parseRotate(s string) error {
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if d, err := time.ParseDuration(p); err == nil {
+			rotateAge = d
+			continue
+		}
+		m := int64(1)
+		switch {
+		case strings.HasSuffix(p, "K"):
+			m = 1 << 10
+		case strings.HasSuffix(p, "M"):
+			m = 1 << 20
+		case strings.HasSuffix(p, "G"):
+			m = 1 << 30
+		}
+		if m != 1 {
+			p = p[:len(p)-1]
+		}
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Bad rotation '%s'. Use a size (eg: 100M), an age (eg: 24h) or both (eg: 100M,24h).", s)
+		}
+		rotateSize = n * m
+	}
+	return nil
+}
+
+// daemonize starts a detached copy of topfast (new session, no terminal) and exits. It returns in the detached copy.
+func daemonize() {
+	if os.Getenv(daemonEnv) == "1" {
+		return // We are the daemon.
+	}
+	exe, err := os.Executable()
+	check(err)
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	check(err)
+	logs := null // Errors go to the output file if any.
+	if outfn != "" {
+		logs, err = os.OpenFile(outfn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		check(err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, logs
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	check(cmd.Start())
+	os.Exit(0)
+}
+
+// writePidfile writes our pid in pidfn. It fails if the pid in an existing pidfile is still running.
+func writePidfile() error {
+	if b, err := ioutil.ReadFile(pidfn); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && pid != os.Getpid() && syscall.Kill(pid, 0) == nil {
+			return fmt.Errorf("%s is already running (pid %d in %s)", os.Args[0], pid, pidfn)
+		}
+	}
+	return ioutil.WriteFile(pidfn, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// cleanup flushes the output and removes the pidfile and the control socket before exiting.
+func cleanup() {
+	flushAlerts(hookTimeout)
+	if outf != nil {
+		outf.f.Sync()
+	}
+	if pidfn != "" {
+		os.Remove(pidfn)
+	}
+	if ctlPath != "" {
+		os.Remove(ctlPath)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+/* Web dashboard.
+* The HTTP server (-l) serves a single page (dashboard.html, embedded in the binary) at / that gets its updates from
+* GET /api/events (server sent events: one message per interval, ?interval=2s by default) and the process tree from /api/tree.
+* The subscribers with the same interval share a feed: one report and one update per tick whatever their number.
+ */
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// jsonUpdate is a dashboard update.
+type jsonUpdate struct {
+	Host        string       `json:"host"`
+	Time        time.Time    `json:"time"`
+	SampleStart time.Time    `json:"sample_start"`
+	ExitCount   uint64       `json:"exit_count"`
+	Interval    float64      `json:"interval_s"`  // time since the previous update (0 for the first one).
+	ExitRate    float64      `json:"exit_rate"`   // exits per second since the previous update.
+	CPUPercent  float32      `json:"cpu_percent"` // accounted cpu since the previous update.
+	Commands    []jsonCmd    `json:"commands"`
+	Histogram   []jsonBucket `json:"histogram"`
+}
+
+func dashboard(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// feed builds the dashboard updates every interval and sends them to its subscribers.
+type feed struct {
+	interval time.Duration
+	subs     map[chan []byte]bool
+	last     []byte // last update (sent first to a new subscriber).
+}
+
+var feedsMu sync.Mutex // guards feeds and their subscribers.
+var feeds = map[time.Duration]*feed{}
+
+// subscribe returns the channel of the updates every i, starting the feed if need be.
+func subscribe(i time.Duration) chan []byte {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+	f := feeds[i]
+	if f == nil {
+		f = &feed{interval: i, subs: map[chan []byte]bool{}}
+		feeds[i] = f
+		go f.run()
+	}
+	c := make(chan []byte, 1)
+	if f.last != nil {
+		c <- f.last
+	}
+	f.subs[c] = true
+	return c
+}
+
+// unsubscribe removes c from the subscribers of the updates every i. The feed stops at its next tick if it was the last one.
+func unsubscribe(i time.Duration, c chan []byte) {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+	delete(feeds[i].subs, c)
+}
+
+// run builds an update every interval and fans it out until there is no subscriber left.
+func (f *feed) run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	hn, _ := os.Hostname()
+	var prev *report
+	for {
+		r := peekReport()
+		b, _ := json.Marshal(newUpdate(hn, r, prev))
+		prev = r
+		feedsMu.Lock()
+		if len(f.subs) == 0 {
+			delete(feeds, f.interval)
+			feedsMu.Unlock()
+			return
+		}
+		f.last = b
+		for c := range f.subs {
+			select {
+			case c <- b:
+			default: // A slow subscriber misses this update.
+			}
+		}
+		feedsMu.Unlock()
+		<-ticker.C
+	}
+}
+
+// newUpdate returns the dashboard update of r. prev is the report of the previous update (nil for the first one).
+func newUpdate(hn string, r, prev *report) *jsonUpdate {
+	u := &jsonUpdate{Host: hn, Time: r.time, SampleStart: r.sampleStart, ExitCount: r.exitCount, Commands: []jsonCmd{}, Histogram: histBuckets(r)}
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	for _, ci := range sortedCmds(r) {
+		u.Commands = append(u.Commands, newJSONCmd(ci, dts))
+	}
+	if prev != nil {
+		u.Interval = r.time.Sub(prev.time).Seconds()
+		u.ExitRate = float64(r.exitCount-prev.exitCount) / u.Interval // exitCount is never reset.
+		et, _ := lifetimeShares(r)
+		if r.sampleStart.Equal(prev.sampleStart) {
+			pet, _ := lifetimeShares(prev)
+			u.CPUPercent = cpuPercent(float64(et-pet), u.Interval*1e6)
+		} else {
+			u.CPUPercent = cpuPercent(float64(et), dts*1e6) // The counters were reset.
+		}
+	}
+	return u
+}
+
+// apiEvents streams the dashboard updates.
+func apiEvents(w http.ResponseWriter, req *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	i := 2 * time.Second
+	if s := req.URL.Query().Get("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 500*time.Millisecond {
+			http.Error(w, fmt.Sprintf("bad interval '%s' (500ms minimum)", s), http.StatusBadRequest)
+			return
+		}
+		i = d
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	c := subscribe(i)
+	defer unsubscribe(i, c)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case b := <-c:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			fl.Flush()
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+/* Exit and fork events listeners and queue.
+* Every exit socket (one per cpu group) and the fork events socket is read by its own goroutine locked on its own thread.
+* The listeners push the events in a bounded lock-free multi producers queue (Vyukov's algorithm: every cell has a
+* sequence number telling if it is free for the producer at position pos or ready for the consumer at position pos).
+* The aggregator goroutine is the single consumer.
+ */
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/neoliv/topfast/taskstats"
+)
+
+const evqSize = 65536 // Must be a power of 2.
+
+const (
+	evExit = iota // a process died (taskstats).
+	evFork        // a process was created (process events connector).
+)
+
+// exitEvent is what we keep from the taskstats of a dying process or from a fork notification.
+type exitEvent struct {
+	kind  int
+	pid   int
+	ppid  int // parent at exit time for evExit, at fork time for evFork.
+	uid   int
+	cpu   uint64 // user+system cpu time [in us]
+	cmd   string // command (evExit only).
+	start uint64 // start time [sec since 1970]
+	rss   uint64 // high water RSS [in KB]
+	rd    uint64 // bytes read from storage.
+	wr    uint64 // bytes written to storage.
+	life  uint64 // lifetime [in us]
+	code  uint32 // exit status (as given by wait).
+}
+
+type exitCell struct {
+	seq uint64
+	ev  exitEvent
+}
+
+var evq [evqSize]exitCell
+var evqHead uint64      // next position to push (shared by producers).
+var evqTail uint64      // next position to pop (written by the consumer only).
+var evqDrops uint64     // events lost because the queue was full.
+var exitOverflows int64 // number of receive buffer overflows on the exit sockets (lost events).
+var exitListeners int64 // number of running listeners (0 means we will not get events anymore).
+var exitErr atomic.Value
+
+// evqWake wakes the aggregator up when it waits for events on an empty queue.
+var evqWake = make(chan struct{}, 1)
+
+var exitConns []*taskstats.Conn  // exit sockets, one per cpu group.
+var forkConn *taskstats.ProcConn // fork events socket (nil if not used).
+var forkOverflows int64          // number of receive buffer overflows on the fork events socket.
+
+func init() {
+	for i := range evq {
+		evq[i].seq = uint64(i)
+	}
+}
+
+// evqPush pushes an event (any goroutine). Returns false and counts a drop if the queue is full.
+func evqPush(ev *exitEvent) bool {
+	pos := atomic.LoadUint64(&evqHead)
+	for {
+		c := &evq[pos&(evqSize-1)]
+		seq := atomic.LoadUint64(&c.seq)
+		dif := int64(seq) - int64(pos)
+		if dif == 0 {
+			if atomic.CompareAndSwapUint64(&evqHead, pos, pos+1) {
+				c.ev = *ev
+				atomic.StoreUint64(&c.seq, pos+1)
+				if pos == atomic.LoadUint64(&evqTail) {
+					wakeAggregator() // The queue was empty, the consumer may be waiting.
+				}
+				return true
+			}
+			pos = atomic.LoadUint64(&evqHead)
+		} else if dif < 0 {
+			atomic.AddUint64(&evqDrops, 1)
+			return false
+		} else {
+			pos = atomic.LoadUint64(&evqHead)
+		}
+	}
+}
+
+// evqPop pops up to len(evs) events (single consumer). Returns the number of events copied in evs.
+func evqPop(evs []exitEvent) int {
+	n := 0
+	for ; n < len(evs); n++ {
+		c := &evq[evqTail&(evqSize-1)]
+		if atomic.LoadUint64(&c.seq) != evqTail+1 {
+			break // empty
+		}
+		evs[n] = c.ev
+		c.ev = exitEvent{} // Do not keep the command string alive.
+		atomic.StoreUint64(&c.seq, evqTail+evqSize)
+		atomic.StoreUint64(&evqTail, evqTail+1)
+	}
+	return n
+}
+
+// wakeAggregator wakes the aggregator up if it waits (never blocks).
+func wakeAggregator() {
+	select {
+	case evqWake <- struct{}{}:
+	default:
+	}
+}
+
+// startExitStats opens one exit socket per group of group cpus (0 for a single group) and starts their listeners.
+// All the possible cpus are registered: a cpu outside our affinity mask or brought online later still has exits.
+func startExitStats(group int) error {
+	cpus, err := possibleCPUs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s, only listening to the exits on cpus 0-%d.\n", err, cpuNb-1)
+		cpus = nil
+		for c := 0; c < int(cpuNb); c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	if group <= 0 || group > len(cpus) {
+		group = len(cpus)
+	}
+	// Open and register all sockets before starting the listeners.
+	for first := 0; first < len(cpus); first += group {
+		mask := cpuList(cpus[first:min(first+group, len(cpus))])
+		c, err := taskstats.Dial()
+		if err != nil {
+			return err
+		}
+		if rcvbuf > 0 {
+			if err = c.SetReadBuffer(rcvbuf); err != nil {
+				c.Close()
+				return err
+			}
+		}
+		if err = c.Register(mask); err != nil {
+			c.Close()
+			return fmt.Errorf("error sending register cpumask '%s': %s", mask, err)
+		}
+		exitConns = append(exitConns, c)
+		go exitListener(c, mask)
+		atomic.AddInt64(&exitListeners, 1)
+	}
+	return nil
+}
+
+// exitListener receives the task exit stats of the cpus in mask and pushes them in the events queue.
+// It will not return unless a fatal error occurs.
+func exitListener(c *taskstats.Conn, mask string) {
+	runtime.LockOSThread() // One thread per socket.
+	defer func() {
+		atomic.AddInt64(&exitListeners, -1)
+		wakeAggregator() // It stops when no listener is left.
+	}()
+	for {
+		sts, err := c.Receive()
+		switch err.(type) {
+		case nil:
+		case *taskstats.Error:
+			exitErr.Store(err)
+			c.Deregister(mask)
+			return
+		default:
+			if err == taskstats.ErrOverrun {
+				// The kernel could not queue some exit events (receive buffer full).
+				atomic.AddInt64(&exitOverflows, 1)
+			} else {
+				fmt.Fprintf(os.Stderr, "nonfatal reply error: %s\n", err)
+			}
+			continue
+		}
+		for _, st := range sts {
+			// Queue it for the aggregator.
+			evqPush(&exitEvent{kind: evExit, pid: int(st.PID), ppid: int(st.PPID), uid: int(st.UID), cpu: st.UTime + st.STime, cmd: st.Comm, start: st.StartTime(), rss: st.HiwaterRSS, rd: st.ReadBytes, wr: st.WriteBytes, life: st.ETime, code: st.ExitCode})
+		}
+	}
+}
+
+// startForkStats starts listening to fork events so we know the parent of every process before it can be reparented.
+func startForkStats() error {
+	c, err := taskstats.DialProc()
+	if err != nil {
+		return err
+	}
+	if rcvbuf > 0 {
+		if err = c.SetReadBuffer(rcvbuf); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	forkConn = c
+	go forkListener(c)
+	return nil
+}
+
+// forkListener receives the fork events and pushes new processes (not threads) in the events queue.
+func forkListener(c *taskstats.ProcConn) {
+	runtime.LockOSThread()
+	for {
+		evs, err := c.Receive()
+		if err == taskstats.ErrOverrun {
+			atomic.AddInt64(&forkOverflows, 1)
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "nonfatal fork events error: %s\n", err)
+			continue
+		}
+		susp := suspendedTime() // The timestamps are monotonic, btime is not.
+		for _, fe := range evs {
+			if fe.ChildPID != fe.ChildTGID {
+				continue // A new thread, not a new process.
+			}
+			evqPush(&exitEvent{kind: evFork, pid: int(fe.ChildTGID), ppid: int(fe.ParentTGID), start: bootTime + (fe.Timestamp+susp)/1e9})
+		}
+	}
+}
+
+// exitError returns the error that stopped a listener (nil if none).
+func exitError() error {
+	if err, ok := exitErr.Load().(error); ok {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/neoliv/topfast
+
+go 1.21
@@ -0,0 +1,46 @@
+package main
+
+/* InfluxDB line protocol format.
+* Every report gives a topfast line (host counters), a topfast_command line per command and a topfast_subtree line per
+* command with subprocesses, all with the report time. host and command are tags.
+* It fits Telegraf exec (-i 0 -d 10s) and execd (stdout) inputs or an InfluxDB write URL as an output (-O influx:1m:http://...).
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Escaping of the measurements and tag values (the ones we write have no quote). A new line (it would end the point)
+// becomes an escaped space: the replacement output is not escaped again.
+var influxEscaper = strings.NewReplacer("\n", `\ `, ",", `\,`, " ", `\ `, "=", `\=`, `\`, `\\`)
+
+// writeInflux writes r to w in the InfluxDB line protocol.
+func writeInflux(w io.Writer, r *report) error {
+	bw := bufio.NewWriter(w)
+	ts := r.time.UnixNano()
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	dtus := dts * 1e6
+	hn, _ := os.Hostname()
+	host := influxEscaper.Replace(hn)
+	aet, slet := lifetimeShares(r)
+	fmt.Fprintf(bw, "topfast,host=%s exits=%di,exit_rate=%f,pid_reuses=%di,busy_us=%di,accounted_us=%di,short_lived_us=%di %d\n",
+		host, r.exitCount, float64(r.exitCount)/dts, r.reusedCount, r.busy, aet, slet, ts)
+	for _, ci := range sortedCmds(r) {
+		cmd := ci.cmd
+		if cmd == "" {
+			cmd = "(vanished)"
+		}
+		cmd = influxEscaper.Replace(cmd)
+		fmt.Fprintf(bw, "topfast_command,host=%s,command=%s et=%di,ec=%di,cpu=%f,rate=%f,slet=%di,slec=%di %d\n",
+			host, cmd, ci.et, ci.ec, cpuPercent(float64(ci.et), dtus), float64(ci.ec)/dts, ci.slet, ci.slec, ts)
+		if ci.subec != 0 {
+			fmt.Fprintf(bw, "topfast_subtree,host=%s,command=%s et=%di,ec=%di,cpu=%f,rate=%f %d\n",
+				host, cmd, ci.subet, ci.subec, cpuPercent(float64(ci.subet), dtus), float64(ci.subec)/dts, ts)
+		}
+	}
+	return bw.Flush()
+}
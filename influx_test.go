@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReport returns a 10s report holding cmds.
+func testReport(cmds ...cmdInfo) *report {
+	t := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	return &report{sampleStart: t.Add(-10 * time.Second), time: t, exitCount: 42, cmds: cmds}
+}
+
+func TestWriteInflux(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+		tag  string // expected command tag.
+	}{
+		{"plain", "sed", "sed"},
+		{"space", "kworker/0:1 events", `kworker/0:1\ events`},
+		{"comma", "a,b", `a\,b`},
+		{"equal", "a=b", `a\=b`},
+		{"backslash", `a\b`, `a\\b`},
+		{"new line", "a\nb", `a\ b`},
+		{"new line and space", "a\n b", `a\ \ b`},
+		{"vanished", "", "(vanished)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeInflux(&b, testReport(cmdInfo{cmd: tt.cmd, et: 2000, ec: 4, subet: 1000, subec: 2})); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+			if len(lines) != 3 {
+				t.Fatalf("%d lines, want 3 (host, command and subtree):\n%s", len(lines), b.String())
+			}
+			for _, l := range lines[1:] {
+				// A point is: measurement,tags fields timestamp. The tag set ends at the first unescaped space.
+				if !strings.Contains(l, ",command="+tt.tag+" ") {
+					t.Errorf("line %q, want the command tag %q", l, tt.tag)
+				}
+				if !strings.HasSuffix(l, " 1767323045000000000") {
+					t.Errorf("line %q, want the report timestamp", l)
+				}
+			}
+			if !strings.Contains(lines[1], " et=2000i,ec=4i,") || !strings.Contains(lines[2], " et=1000i,ec=2i,") {
+				t.Errorf("fields of %q and %q", lines[1], lines[2])
+			}
+		})
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var body, ct, user string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		body, ct = string(b), req.Header.Get("Content-Type")
+		user, _, _ = req.BasicAuth()
+		w.WriteHeader(status)
+		if status != http.StatusNoContent {
+			w.Write([]byte("database not found\n"))
+		}
+	}))
+	defer srv.Close()
+	u := strings.Replace(srv.URL, "http://", "http://topfast:secret@", 1) + "/write?db=topfast"
+	s, err := newSink("influx", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Write(testReport(cmdInfo{cmd: "sed", et: 2000, ec: 4})); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(body, "topfast,host=") || !strings.Contains(body, "\ntopfast_command,") {
+		t.Errorf("body %q, want the line protocol", body)
+	}
+	if ct != "text/plain; charset=utf-8" || user != "topfast" {
+		t.Errorf("content type %q user %q", ct, user)
+	}
+	status = http.StatusNotFound
+	err = s.Write(testReport())
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found database not found") {
+		t.Errorf("error %v, want the status and the message", err)
+	}
+}
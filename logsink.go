@@ -0,0 +1,184 @@
+package main
+
+/* Syslog and journald sinks.
+* Every report gives a summary message (exit rate, short lived cpu) and a message per top command, every alert a message.
+* -O syslog:[interval]:[destination] writes RFC 5424 messages to the local socket (destination empty or a socket path) or
+* over UDP (host[:port]), with the values as structured data. -O journald:[interval]:[socket path] uses the journald native
+* protocol with the values as fields (COMMAND=, CPU_PERCENT=, ...).
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	syslogSocket   = "/dev/log"
+	journaldSocket = "/run/systemd/journal/socket"
+	syslogFacility = 3     // daemon
+	syslogPEN      = 32473 // private enterprise number of the structured data id (the documentation one).
+)
+
+// RFC 5424 timestamp layout: at most 6 fraction digits.
+const syslogTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// Severities.
+const (
+	sevWarning = 4
+	sevNotice  = 5
+	sevInfo    = 6
+)
+
+// logField is a value of a message: a journald field, a structured data parameter (lower case) for syslog.
+type logField struct {
+	name  string
+	value string
+}
+
+// logSink sends the reports and the alerts to syslog or journald.
+type logSink struct {
+	mu      sync.Mutex // reports and alerts come from different goroutines.
+	format  string     // syslog or journald.
+	network string
+	addr    string
+	conn    net.Conn
+	host    string
+}
+
+func newLogSink(format, dest string) (*logSink, error) {
+	s := &logSink{format: format, network: "unixgram", addr: dest}
+	s.host, _ = os.Hostname()
+	switch {
+	case dest == "" && format == "journald":
+		s.addr = journaldSocket
+	case dest == "":
+		s.addr = syslogSocket
+	case format == "syslog" && !strings.HasPrefix(dest, "/"):
+		s.network = "udp"
+		if _, _, err := net.SplitHostPort(dest); err != nil {
+			s.addr = net.JoinHostPort(dest, "514")
+		}
+	}
+	return s, s.dial()
+}
+
+func (s *logSink) dial() error {
+	c, err := net.Dial(s.network, s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = c
+	return nil
+}
+
+func (s *logSink) Write(r *report) error {
+	displayMu.Lock()
+	t := top // The control socket and a reload change it.
+	displayMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	dtus := dts * 1e6
+	aet, slet := lifetimeShares(r)
+	var slpc float64
+	if aet != 0 {
+		slpc = 100 * float64(slet) / float64(aet)
+	}
+	exitRate := f64(float64(r.exitCount) / dts)
+	err := s.send(sevInfo, "summary", fmt.Sprintf("%d exits (%se/s) in %s, short lived cpu %.2f%%", r.exitCount, exitRate, time.Duration(dts*1e9).Round(time.Millisecond), slpc),
+		logField{"EXIT_COUNT", u64(r.exitCount)}, logField{"EXIT_RATE", exitRate}, logField{"SHORT_LIVED_CPU_PERCENT", f64(slpc)})
+	n := 0
+	for _, ci := range sortedCmds(r) {
+		if n >= t {
+			break
+		}
+		if ci.et+ci.ec == 0 {
+			continue
+		}
+		n++
+		cpu := f64(float64(cpuPercent(float64(ci.et), dtus)))
+		rate := f64(float64(ci.ec) / dts)
+		e := s.send(sevInfo, "command", fmt.Sprintf("%s: %s%% cpu (%s), %d exec (%se/s)", ci.cmd, cpu, time.Duration(ci.et*1e3), ci.ec, rate),
+			logField{"COMMAND", ci.cmd}, logField{"CPU_PERCENT", cpu}, logField{"EXEC_TIME_US", u64(ci.et)}, logField{"EXEC_COUNT", u64(ci.ec)}, logField{"EXEC_RATE", rate})
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Alert sends a.
+func (s *logSink) Alert(a *alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sev := sevWarning
+	if a.State == "clear" {
+		sev = sevNotice
+	}
+	msg := fmt.Sprintf("alert %s: %s (value %.2f, command %s", a.State, a.Rule, a.Value, a.Command)
+	if len(a.Ancestry) != 0 {
+		msg += ", ancestry " + strings.Join(a.Ancestry, " ")
+	}
+	return s.send(sev, "alert", msg+")",
+		logField{"ALERT_RULE", a.Rule}, logField{"ALERT_STATE", a.State}, logField{"ALERT_VALUE", f64(a.Value)},
+		logField{"COMMAND", a.Command}, logField{"ANCESTRY", strings.Join(a.Ancestry, " ")}, logField{"CPU_PERCENT", f64(a.CPUPercent)},
+		logField{"EXEC_RATE", f64(a.ExecRate)}, logField{"EXIT_RATE", f64(a.ExitRate)})
+}
+
+// send sends a message, dialing again once if the socket fails (syslog or journald restarted). s.mu must be held.
+func (s *logSink) send(sev int, msgid, msg string, fs ...logField) error {
+	var b []byte
+	if s.format == "journald" {
+		b = journaldMessage(sev, msgid, msg, fs)
+	} else {
+		b = s.syslogMessage(sev, msgid, msg, fs)
+	}
+	_, err := s.conn.Write(b)
+	if err != nil && s.dial() == nil {
+		_, err = s.conn.Write(b)
+	}
+	return err
+}
+
+// Escaping of the structured data parameter values.
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "]", `\]`)
+
+// syslogMessage formats an RFC 5424 message.
+func (s *logSink) syslogMessage(sev int, msgid, msg string, fs []logField) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s topfast %d %s [topfast@%d", syslogFacility*8+sev, time.Now().Format(syslogTime), s.host, os.Getpid(), msgid, syslogPEN)
+	for _, f := range fs {
+		fmt.Fprintf(&b, ` %s="%s"`, strings.ToLower(f.name), sdEscaper.Replace(f.value))
+	}
+	b.WriteString("] ")
+	b.WriteString(msg)
+	return b.Bytes()
+}
+
+// journaldMessage formats a journald native protocol message.
+func journaldMessage(sev int, msgid, msg string, fs []logField) []byte {
+	var b bytes.Buffer
+	fs = append([]logField{{"MESSAGE", msg}, {"PRIORITY", strconv.Itoa(sev)}, {"SYSLOG_IDENTIFIER", "topfast"}, {"TOPFAST_EVENT", msgid}}, fs...)
+	for _, f := range fs {
+		if !strings.Contains(f.value, "\n") {
+			fmt.Fprintf(&b, "%s=%s\n", f.name, f.value)
+			continue
+		}
+		// A value with new lines: the name, a new line, the little endian 64 bits length then the value.
+		b.WriteString(f.name + "\n")
+		binary.Write(&b, binary.LittleEndian, uint64(len(f.value)))
+		b.WriteString(f.value + "\n")
+	}
+	return b.Bytes()
+}
+
+func (s *logSink) Close() error {
+	return s.conn.Close()
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path"
-	"regexp"
 	"runtime"
 	"syscall"
 	"time"
+
+	"github.com/neoliv/topfast/taskstats"
 )
 
 var myUsage = func() {
@@ -24,6 +26,14 @@ This tool does that but also uses the taskstats netlink kernel API to get stats
 Note that you need to have root privileges.
 You can ask for an updated display by sending SIGUSR1 (eg: pkill -USR1 %s)
 You can reset the counters with SIGUSR2.
+Additional outputs (-O) get the reports in their own format (text, raw, json: one object per line, csv, tsv or influx) at their own interval. The destination is a file, - for stdout or an http(s) URL every report is posted to. With -c every output shows the stats of its own interval.
+eg: %s -c -i 10s -O json:1m:/var/log/%s.json
+
+SIGHUP reopens the output file (-o) for logrotate and reloads the configuration file (-F), SIGTERM writes a final report then exits.
+
+The configuration file (-F) is a JSON object with these keys (the command line options win over them): interval, sort, top, clear, raw, format, columns, histogram, tree, parents, output, sinks (list), rotate, keep, filters (list), groups (object name: regexp), rules (list), hooks (list), events, http, daemon, pidfile, control, ancestry, exit_group and rcvbuf. A reload keeps the counters and does not change sinks, events, http, daemon, pidfile, control, ancestry, exit_group and rcvbuf.
+eg: {"interval": "10m", "clear": true, "top": 20, "groups": {"php": "^php"}, "rules": ["exitrate > 500 for 30s"], "hooks": ["file:/var/log/topfast.alerts"]}
+With a control socket (-S) you can dump the stats, reset the counters, change the sort criteria, top, interval and filters or get the status of a running %s without restarting it: %s ctl [-S socket] help
 
 eg: %s -i 30s -o /tmp/%s.out
   This will store stats every 30s in the %s.out file.
@@ -31,6 +41,12 @@ eg: %s -i 30s -o /tmp/%s.out
 eg: %s -c -i 10m | tee /tmp/%s.out
   This will display and store stats every 10m. But the -c reset the counters so stats displayed are for the last 10m only.
 
+eg: %s -D -p /run/%s.pid -o /var/log/%s.log -R 100M,24h -k 7 -c -i 10m
+  This will run in the background, store stats every 10m and rotate the log file every day or at 100MB keeping 7 old files.
+
+eg: %s -c -i 10s -n 6
+  This will display stats every 10s for one minute then exit (use -d for a total duration and a final display). The exit status is 1 if an alert rule (-a) fired during the run, 0 otherwise.
+
 Notes about the displayed informations:
 
 The execution time (et) is the user+system CPU usage. 
@@ -45,23 +61,68 @@ eg: ??
 
 The second list displays statistics for a command and all its subprocesses. The displayed counters (et, ec, ...) are sums for the command and all its descendant subprocesses.
 eg??
+When a parent dies before its children they are reparented to init (or to a subreaper like systemd --user). By default (-A original) the parent seen at fork time is kept so a script that daemonizes workers is still credited with them. Use -A current to credit the parent at exit time.
+
+The process tree (-T) shows process instances instead of commands: every line is a pid with its own counters and the ones of all its subprocesses (sub), indented under its parent. It is pruned to the top branches so you can see which parent process is behind the load, not only which command.
+
+The parent processes list (-P) is keyed by live pid: how many children every process spawned per second and the CPU they used. It catches the one runaway shell among hundreds of harmless ones that the second list merges in a single line.
  
+The third list displays, for every command, the CPU used by its short lived instances (sl) and by its long lived ones (ll). A process is short lived when it started and died between two displays, so no sampling pass ever saw it alive: this is the load top would have missed. The header gives the overall short lived share of the accounted CPU.
+
 You can sort commands by execution time of number of executions.
 
+Alert rules (-a) are evaluated every second, independently of the displays: "[metric] > [value] for [duration]" (or <) where metric is exitrate (exits/s), slcpu (short lived cpu %%), cpu:[command] (cpu %%) or rate:[command] (exec/s). A rule fires when its condition held for the duration and clears as soon as it is false. Rates are averages over the sample so use -c to get the recent ones, the cpu of the long lived processes is the one of the last display.
+Every hook (-x) gets the rule, its state (fire or clear), the offending command (the top one for exitrate and slcpu), the ancestry of its last instance and the current rates as a JSON line: appended to a file (file:[path]), written to a unix socket (unix:[path]) or on the stdin of a shell command that also gets them as TOPFAST_RULE, TOPFAST_STATE, TOPFAST_VALUE, TOPFAST_LIMIT, TOPFAST_COMMAND, TOPFAST_ANCESTRY, TOPFAST_EXIT_RATE, TOPFAST_CPU_PERCENT and TOPFAST_EXEC_RATE environment variables. The hooks run one at a time, in their own goroutine, and a shell command still running after 10s is killed.
+eg: %s -c -i 10s -a 'exitrate > 500 for 30s' -x 'logger -t topfast "$TOPFAST_STATE $TOPFAST_RULE: $TOPFAST_COMMAND ($TOPFAST_ANCESTRY)"'
+
+With -check, %s is a Nagios/Icinga plugin: it samples for the given duration then prints one status line with perfdata (exitrate, slcpu and the metrics of the thresholds) and exits with the plugin status. A critical (-crit) or warning (-warn) threshold is a rule like -a.
+eg: %s -check 30s -warn 'slcpu > 10' -crit 'slcpu > 25' -crit 'exitrate > 500'
+
+The csv and tsv formats (-format) have a header row then one row per command and display with the columns chosen with -cols. Times are in us, cpu in percent, rate in exec/s, rss (biggest high water RSS) in KB, rd and wr (storage I/O) in bytes. The percentiles (eg: p90), uid, rss, rd and wr only cover the exited instances, the percentiles are approximated to 10%%.
+eg: %s -c -i 1m -format csv -cols time,cmd,ec,et,avg,p50,p99,uid,rss,rd,wr -o /var/log/%s.csv
+
+The influx format is the InfluxDB line protocol: a topfast measurement (exits, exit_rate, busy and accounted cpu), a topfast_command one per command and a topfast_subtree one per command with subprocesses (et, ec, cpu, rate), tagged with host and command and timestamped at the display. Use it with the Telegraf execd input (stdout), the exec input (-i 0 -d [duration] for one report) or post it to an InfluxDB write URL (the URL user and password are sent as basic auth).
+eg: %s -c -i 10s -O influx:1m:http://localhost:8086/write?db=%s
+
+The statsd and graphite outputs push metrics named topfast.[host].[command].[metric] (anything but letters, digits, - and _ becomes _ in host and command) plus topfast.[host].exits and exit_rate to a host:port. StatsD gets the et, ec, subet and subec increments as counters and the cpu and rate as gauges. Graphite gets et, ec, cpu, rate, subet and subec with the report time (use -c for per interval values).
+eg: %s -c -i 1m -O statsd:10s:localhost:8125 -O graphite:1m:graphite.example.com:2003
+
+The syslog and journald outputs send a summary message (exit rate, short lived cpu) and a message per top command (-t) every interval, plus a message every time an alert rule (-a) fires (warning) or clears (notice). syslog messages are RFC 5424 with the values as structured data (command, cpu_percent, exec_rate, ...) sent to the local socket (empty destination or a socket path) or over UDP (host[:port]). journald messages use the native protocol with the values as fields (COMMAND=, CPU_PERCENT=, EXEC_RATE=, ALERT_RULE=, ...).
+eg: %s -c -i 10m -a 'exitrate > 500 for 30s' -O journald:10m: -O syslog:1h:loghost.example.com
+
+With -e, the output gets a record per process exit as it happens instead of the reports: time, command[pid], ppid, uid, cpu, lifetime, exit code (or the killing signal) and ancestry (closest parent first, the original one with -A original), as text or JSON lines. The filters (-f) select the commands, the additional outputs (-O) and the alert rules still work.
+eg: %s -e json -f '^curl$' -o /var/log/%s.curl
+
+The HTTP JSON API (-l) serves GET /api/commands and /api/subtree (sort=time|count and top=N query parameters), /api/histogram, /api/tree (the live process tree), /api/report (the json format), /api/status (counters and health, 503 when no exit events can be received anymore) and POST /api/reset. The same server has a web dashboard at / (a sortable command table, a rolling exec rate and cpu chart, the histogram and an expandable process tree, updated live). There is no authentication, listen on localhost or a trusted network.
+eg: %s -l localhost:8080 & curl 'localhost:8080/api/commands?sort=count&top=5'
+
 If you need more help feel free to contact Olivier Arsac topfast@arsac.org.
-`, c, c, c, c, c, c)
+`, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c)
 }
 
 var sortKey string
 var outfn string
-var out *os.File
+var out io.Writer
 var interval time.Duration
 var top int
-var raw, clear, hist bool
-var cpuNb uint // Number of CPUs(cores) on this server. Set during init().
+var count int              // number of displays before exiting (0 for no limit).
+var duration time.Duration // run duration before a final display and exit (0 for no limit).
+var rcvbuf int             // netlink sockets receive buffer size in bytes (0 for system default).
+var group int              // number of CPUs per exit socket (0 for a single socket).
+var ancestry string
+var origAncestry bool // credit the parent at fork time (true) or the current parent (false).
+var raw, clear, hist, tree, parents bool
+var formatOpt string       // -format value.
+var dispFormat string      // format of the main display (-format or -r).
+var cpuNb uint             // Number of CPUs(cores) on this server. Set during init().
+var probe *taskstats.Stats // Stats of our own process read at startup, tells which taskstats fields this kernel provides.
 
 // Check e, if not nil print to stderr and exit.
 func check(e error) {
+	if e != nil && checkDur > 0 {
+		fmt.Printf("TOPFAST UNKNOWN - %s\n", e)
+		os.Exit(checkUnknown)
+	}
 	if e != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
 		os.Exit(1)
@@ -80,89 +141,254 @@ func cpuPercent(et, st float64) float32 {
 func parseOpts() {
 	sortCriteria = scTime
 	flag.Usage = myUsage
-	flag.StringVar(&outfn, "o", "", "output file (default is stdout).")
+	defineFlags()
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if checkDur > 0 {
+			os.Exit(checkUnknown)
+		}
+		os.Exit(2)
+	}
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	if cfgPath != "" {
+		check(loadConfig(cfgPath, true))
+	}
+	check(checkOpts())
+	setGroups(groups)
+	aggOpts = newAggOptions()
+	if daemon {
+		daemonize()
+	}
+	check(setOutput())
+	if pidfn != "" {
+		check(writePidfile())
+	}
+}
+
+// defineFlags defines the command line options of flag.CommandLine.
+func defineFlags() {
+	flag.StringVar(&outfn, "o", "", "output file (default is stdout). It is appended to and reopened on SIGHUP.")
+	flag.Var(&sinkSpecs, "O", "additional output [format]:[interval]:[destination], can be repeated. Formats: text, raw, json, csv, tsv or influx. Destination: a file, - for stdout or an http(s) URL the reports are posted to. Or statsd (UDP) and graphite (TCP) to a host:port, syslog to a socket path (default /dev/log) or a host[:port] (UDP) and journald (default socket). eg: -O json:1m:/var/log/topfast.json")
+	flag.BoolVar(&daemon, "D", false, "daemon mode: run detached from the terminal (use -o, errors go to the output file too).")
+	flag.StringVar(&pidfn, "p", "", "pidfile path.")
+	flag.StringVar(&rotateSpec, "R", "", "rotate the output file when it reaches a size (eg: 100M), an age (eg: 24h) or both (eg: 100M,24h).")
+	flag.IntVar(&keep, "k", 7, "number of rotated output files kept (file.1 is the newest).")
 	flag.StringVar(&sortKey, "s", "time", "sort criteria (time or count, default is time).")
 	defi, _ := time.ParseDuration("10s")
 	flag.DurationVar(&interval, "i", defi, "interval between automatic stats output (eg: 30s, 10m, 2h).")
+	flag.StringVar(&httpAddr, "l", "", "HTTP JSON API and web dashboard listen address (eg: localhost:8080), see the /api/ paths below.")
+	flag.StringVar(&ctlPath, "S", "", "control socket path (eg: "+defaultSocket+"), see '"+path.Base(os.Args[0])+" ctl help'.")
+	flag.Var(&filters, "f", "only display the commands matching this regexp, can be repeated.")
+	flag.Var(&groups, "G", "count the commands matching a regexp under a single name, can be repeated. eg: -G 'php=^php'")
+	flag.StringVar(&cfgPath, "F", "", "configuration file (JSON), reloaded on SIGHUP. The command line options win over it.")
+	flag.IntVar(&count, "n", 0, "exit after this number of displays (0 for no limit).")
+	flag.DurationVar(&duration, "d", 0, "exit after this duration with a final display (0 for no limit). eg: -d 1h")
+	flag.StringVar(&eventFmt, "e", "", "stream a record per process exit to the output instead of the reports: text or json (one object per line). -f filters the commands.")
 	flag.BoolVar(&raw, "r", false, "output stats in a raw format easier to parse unsing scripts).")
+	flag.StringVar(&formatOpt, "format", "", "output format: text, raw (same as -r), json (one object per line), csv or tsv (one row per command, see -cols) or influx (InfluxDB line protocol).")
+	flag.StringVar(&colsSpec, "cols", defaultCols, "columns of the csv and tsv formats: "+columnNames()+" or p[percentile] (eg: p95).")
 	flag.BoolVar(&clear, "c", false, "clear counters every time we display stats.")
 	flag.BoolVar(&hist, "H", false, "display execution time history.")
+	flag.BoolVar(&tree, "T", false, "display the process tree: top process instances by subtree (own plus subprocesses) usage, indented by ancestry.")
+	flag.BoolVar(&parents, "P", false, "display the parent processes (pids) with the most children and their children cpu.")
 	flag.IntVar(&top, "t", 10, "number of lines in the top sections.")
-	flag.Parse()
+	flag.StringVar(&ancestry, "A", "original", "parent credited with a subprocess stats: original (parent at fork time, follows daemonized processes) or current (parent after reparenting, often init or a subreaper).")
+	flag.Var(&rules, "a", "alert rule, can be repeated. eg: -a 'exitrate > 500/s for 30s' -a 'cpu:grep > 20%'. Metrics: exitrate, slcpu, cpu:[command], rate:[command].")
+	flag.Var(&hooks, "x", "alert hook called when a rule fires or clears, can be repeated: a shell command, file:[path] or unix:[socket path].")
+	flag.IntVar(&group, "g", 0, "number of CPUs per exit socket, each socket being read by its own thread (0 for a single socket listening to all CPUs). eg: -g 8 on a 64 cores server.")
+	flag.IntVar(&rcvbuf, "b", 0, "netlink receive buffer size in bytes (0 for system default). Raise it if the header shows lost exit events.")
+	flag.DurationVar(&checkDur, "check", 0, "check mode (Nagios/Icinga plugin): sample for this duration, print one status line with perfdata and exit 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN).")
+	flag.Var(&warnRules, "warn", "check mode warning threshold, a rule like -a (the for part is ignored), can be repeated. eg: -warn 'slcpu > 10'")
+	flag.Var(&critRules, "crit", "check mode critical threshold, a rule like -a (the for part is ignored), can be repeated. eg: -crit 'cpu:grep > 25'")
+}
+
+// checkOpts checks the options that are not checked while parsing and sets the values derived from them.
+func checkOpts() error {
 	switch sortKey {
 	case "count":
 		sortCriteria = scCount
 	case "time":
 		sortCriteria = scTime
 	default:
-		check(fmt.Errorf("Unknown sort criteria '%s'. Use -s 'count' or 'time'.", sortKey))
+		return fmt.Errorf("Unknown sort criteria '%s'. Use -s 'count' or 'time'.", sortKey)
+	}
+	dispFormat = formatOpt
+	if dispFormat == "" {
+		dispFormat = "text"
+		if raw {
+			dispFormat = "raw"
+		}
 	}
-	if outfn != "" {
-		var err error
-		out, err = os.Create(outfn)
-		check(err)
-	} else {
-		out = os.Stdout
+	if !formats[dispFormat] {
+		return fmt.Errorf("Unknown format '%s'. Use text, raw, json, csv, tsv or influx.", dispFormat)
 	}
+	raw = dispFormat == "raw"
+	rotateSize, rotateAge = 0, 0
+	if rotateSpec != "" {
+		if outfn == "" {
+			return fmt.Errorf("Rotation (-R) needs an output file (-o).")
+		}
+		if err := parseRotate(rotateSpec); err != nil {
+			return err
+		}
+	}
+	var err error
+	if cols, err = parseCols(colsSpec); err != nil {
+		return err
+	}
+	if eventFmt != "" && eventFmt != "text" && eventFmt != "json" {
+		return fmt.Errorf("Unknown exit records format '%s'. Use -e 'text' or 'json'.", eventFmt)
+	}
+	if daemon && outfn == "" && httpAddr == "" && !detachedSink() {
+		return fmt.Errorf("Daemon mode (-D) has no terminal, it needs an output file (-o), a sink that does not write to stdout (-O) or the HTTP API (-l).")
+	}
+	switch ancestry {
+	case "original":
+		origAncestry = true
+	case "current":
+		origAncestry = false
+	default:
+		return fmt.Errorf("Unknown ancestry '%s'. Use -A 'original' or 'current'.", ancestry)
+	}
+	return nil
 }
 
 // Handle signals (output stats).
 func trap() {
 	c := make(chan os.Signal, 1)
 	//signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, os.Interrupt)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
 	for s := range c {
-		stats()
+		if s == syscall.SIGHUP {
+			// logrotate moved the output file.
+			if outf != nil {
+				displayMu.Lock()
+				if err := outf.reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				}
+				displayMu.Unlock()
+			}
+			if cfgPath != "" {
+				if err := reloadConfig(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				}
+			}
+			continue
+		}
+		stats(s == syscall.SIGUSR2)
 		switch s {
 		case syscall.SIGTERM, os.Interrupt:
-			fmt.Fprintf(out, "Received %s Signal. Exiting.\n", s)
+			displayMu.Lock() // No display after the final one.
+			if eventFmt == "" && (dispFormat == "text" || dispFormat == "raw") {
+				fmt.Fprintf(out, "Received %s Signal. Exiting.\n", s)
+			}
+			cleanup()
 			os.Exit(0)
-		case syscall.SIGUSR2:
-			clearCounters()
 		}
 
 	}
 }
 
-// Output stats periodicaly.
+// tickDisplay displays the stats every i (none if i is 0). The control socket can change i.
 func tickDisplay(i time.Duration) {
-	ticker := time.NewTicker(i)
-	for _ = range ticker.C {
-		stats()
-		if clear {
-			clearCounters()
+	ticker := time.NewTicker(time.Hour)
+	ticker.Stop()
+	if i > 0 {
+		ticker.Reset(i)
+	}
+	for {
+		select {
+		case <-ticker.C:
+			displayMu.Lock()
+			c := clear // A reload may change it.
+			displayMu.Unlock()
+			if stats(c) >= uint(count) && count > 0 {
+				finish()
+			}
+		case i = <-intervalCh:
+			ticker.Stop()
+			if i > 0 {
+				ticker.Reset(i)
+			}
 		}
 	}
 }
 
+// stopAfter displays the final stats and exits after d.
+func stopAfter(d time.Duration) {
+	time.Sleep(d)
+	stats(false)
+	finish()
+}
+
+// finish exits a bounded run (-n or -d). The exit status is 1 if an alert rule fired during the run.
+func finish() {
+	displayMu.Lock() // No display after the final one.
+	cleanup()
+	if alertFired {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 // Clean process info map periodicaly.
 func tickCPIs(i time.Duration) {
 	ticker := time.NewTicker(i)
 	for _ = range ticker.C {
-		cleanProcInfos()
+		aggReqs <- aggReq{op: aggClean}
 	}
 }
 
-// Check if the kernel version supports all the parameters of the taskstat API that we will use.
+// Check if the kernel taskstats version supports the fields we need and probe the optional ones.
+// The version is read from the stats of our own process.
 func checkKernel() {
+	c, err := taskstats.Dial()
+	if err != nil {
+		return // initNetlink will report the error.
+	}
+	defer c.Close()
+	st, err := c.PID(os.Getpid())
+	if err != nil {
+		return
+	}
 	kv, _ := kernelVersion()
-	if kv != "" {
-		match, _ := regexp.MatchString("2[.]6[.]1", kv)
-		if match {
-			fmt.Printf("This tool does not work for this Linux (kernel %s)\n", kv)
-			os.Exit(1)
-		}
+	if !st.Has(taskstats.Basic) {
+		check(fmt.Errorf("This tool does not work for this Linux (kernel %s, taskstats version %d)", kv, st.Version))
 	}
+	probe = st
 }
 
 func main() {
-	checkKernel()
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctl(os.Args[2:]))
+	}
 	parseOpts()
+	checkKernel()
+	if checkDur > 0 {
+		check(initNetlink())
+		runCheck()
+	}
 	// Trap sigusr to display stats
 	go trap()
-	if interval != 0 {
-		// Display periodicaly.
-		go tickDisplay(interval)
+	// Display periodicaly.
+	go tickDisplay(interval)
+	go tickRules()
+	go deliverAlerts()
+	if ctlPath != "" {
+		check(listenControl(ctlPath))
+	}
+	if httpAddr != "" {
+		check(listenHTTP(httpAddr))
+	}
+	check(startSinks())
+	if eventFmt != "" {
+		go writeStream()
+	}
+	if duration > 0 {
+		go stopAfter(duration)
 	}
 	// clean process infos map every 5min
 	go tickCPIs(5 * 60 * time.Second)
@@ -171,10 +397,8 @@ func main() {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 	}
-	// Init cpu counters for all current processes (to get long lived ones).
-	updateLongLivedStats(true)
-	// Infinite wait for exit events.
-	err = getExitStats()
+	// Infinite wait for exit events (and requests from the other goroutines).
+	err = aggregate(group)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 	}
@@ -6,20 +6,21 @@ package main
 * Any dead process will trigger a walk up its list of ancestors (using ppid fields). All ancestors will be credited this process resource usage.
  */
 
-/*
-#include "nlstats.c"
-*/
-import "C"
-
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/neoliv/topfast/taskstats"
 )
 
 const (
@@ -31,12 +32,21 @@ var scStrings = [2]string{}
 var sortCriteria int
 var vanishedCount uint64   // number of failed read in /proc/#/stat == vanished proces count.
 var removedCount uint64    // how many removed processes.
+var reusedCount uint64     // how many recycled pids were detected (same pid, different start time).
 var exitCount uint64       // how many exit events send from kernel.
 var sessionStart time.Time // This process start time.
 var sampleStart time.Time  // Current sample start time.
 var ehist = [32]uint64{}   // execution time histogram
 var sample uint = 0        // number of samples done.
 var display uint = 0       // number of displays done.
+var displayMu sync.Mutex   // displays come from the ticker, the signals and the control socket.
+var sampleBusy uint64      // busy cpu time of all CPUs (from /proc/stat) at the current sample start, 0 if unknown. [in us]
+var qconn *taskstats.Conn  // netlink socket used to request the stats of a given pid.
+var bootTime uint64        // system boot time [sec since 1970] (from /proc/stat).
+
+// Clock ticks per second, the unit of the /proc counters (USER_HZ). Read from the auxiliary vector, 100 (the value on
+// most architectures) if it can not be.
+var clkTck uint64 = 100
 
 type cmdInfo struct {
 	cmd   string // command
@@ -44,18 +54,38 @@ type cmdInfo struct {
 	subet uint64 // sum of execution time in all sub processes. [in us]
 	ec    uint64 // number of times this command has been seedn.
 	et    uint64 // sum of exec time in all instances of this command. [in us]
+	slec  uint64 // number of short lived instances (exited before any sampling pass saw them).
+	slet  uint64 // sum of exec time in short lived instances. [in us]
 	spid  int    // source pid of the last tree walk up that updated sub*
+	ppid  int    // parent pid of the last instance counted.
+	// Exited instances only (taskstats gives them at exit).
+	uid   int               // user of the last exited instance.
+	rss   uint64            // biggest high water RSS. [in KB]
+	rd    uint64            // bytes read from storage.
+	wr    uint64            // bytes written to storage.
+	xhist [xhistSize]uint32 // exec time distribution (see xhistIndex).
 }
 
 type procInfo struct {
-	pid  int       // this process PID
-	ppid int       // parent PID
-	ppi  *procInfo // Parent process info.
-	ci   *cmdInfo  // Info about all processes sharing this command.
-	cpu  uint64    // cpu exec time since start of process (in us)
+	pid   int       // this process PID
+	ppid  int       // parent PID
+	ppi   *procInfo // Parent process info.
+	ci    *cmdInfo  // Info about all processes sharing this command.
+	cpu   uint64    // cpu exec time since start of process (in us)
+	seen  bool      // true if a sampling pass (updateLongLivedStats) saw this process alive.
+	start uint64    // process start time [sec since 1970]. With pid it identifies a process (pids are recycled).
+	gen   uint      // sample number of ci and of the instance counters below (they are replaced at every reset).
+	et    uint64    // exec time of this process in the current sample. [in us]
+	ec    uint64    // 1 if this process was counted as an execution in the current sample.
+	subet uint64    // sum of exec time of the descendants of this process in the current sample. [in us]
+	subec uint64    // number of descendants of this process counted in the current sample.
+	cet   uint64    // sum of exec time of the children (first level only) of this process in the current sample. [in us]
+	cec   uint64    // number of children of this process counted in the current sample.
+	comm  string    // command when it forked a child while only known from its own fork event (exit records ancestry).
 }
 
-var mutInfos = sync.Mutex{} // protect the *info maps
+// The *info maps, the histogram and the counters are owned by the aggregator goroutine (see aggregate()).
+// Other goroutines send it requests and get consistent reports back.
 
 // For every command stores its ifnormations.
 var cmdInfos = map[string](*cmdInfo){}
@@ -63,29 +93,199 @@ var cmdInfos = map[string](*cmdInfo){}
 // For every PID stores its informations.
 var procInfos = map[int](*procInfo){}
 
+const (
+	aggStats    = iota // update long lived processes stats and send back a report.
+	aggSnapshot        // send back a report of the counters as they are (no sampling pass).
+	aggClear           // reset counters.
+	aggClean           // remove dead processes from procInfos.
+	aggSettings        // replace the command grouping rules and the options.
+	aggTree            // send back a report with all the known processes in procs.
+)
+
+// aggReq is a request sent to the aggregator goroutine.
+type aggReq struct {
+	op     int
+	reset  bool         // aggStats: reset counters once the report is built (nothing is lost between the two).
+	reply  chan *report // aggStats, aggSnapshot, aggTree: where the report is sent.
+	groups groupList    // aggSettings: the new rules.
+	opts   aggOptions   // aggSettings: the new options.
+}
+
+// aggOptions is the aggregator copy of the options a reload may change (the options side is guarded by displayMu).
+type aggOptions struct {
+	clear, hist, tree, parents bool
+	alerts                     bool // there are alert rules (the reports need the ancestries).
+}
+
+var aggOpts aggOptions // Runs in the aggregator (set before it starts).
+
+var aggReqs = make(chan aggReq)
+
+// report is a snapshot of the aggregated stats taken by the aggregator for a display.
+type report struct {
+	sampleStart time.Time
+	time        time.Time // when the report was built.
+	busy        uint64    // busy cpu time of all CPUs since sample start. [in us]
+	exitCount   uint64
+	reusedCount uint64
+	ehist       [32]uint64
+	cmds        []cmdInfo
+	procs       []procNode          // process tree (only with -T).
+	parents     []procNode          // live processes with children counted in the sample (only with -P).
+	ancestry    map[string][]string // ancestry of the last instance of every command (only with alert rules).
+	opts        aggOptions          // options of the aggregator when the report was built.
+}
+
+// procNode is a process instance of the tree report.
+type procNode struct {
+	pid    int
+	ppid   int
+	cmd    string
+	et     uint64 // own exec time. [in us]
+	ec     uint64
+	subet  uint64 // exec time of all descendants. [in us]
+	subec  uint64
+	cet    uint64 // exec time of the children. [in us]
+	cec    uint64
+	parent int // index of the parent node in report.procs (-1 for a root).
+}
+
 func init() {
 	sessionStart = time.Now()
 	sampleStart = sessionStart
 	sortCriteria = scTime
 	scStrings[scCount] = "number of exit"
 	scStrings[scTime] = "execution time"
+	if hz, err := userHZ(); err == nil {
+		clkTck = hz
+	}
+	sampleBusy, _ = busyTime()
+	bootTime, _ = readBootTime()
+}
+
+// busyTime returns the busy cpu time of all CPUs since boot as seen in /proc/stat. [in us]
+func busyTime() (uint64, error) {
+	b, err := cpuBusyTime()
+	if err != nil {
+		return 0, err
+	}
+	return b * 1e6 / clkTck, nil
 }
 
 // Reset all counters for a new sample (like a fresh start).
 func clearCounters() {
+	aggReqs <- aggReq{op: aggClear}
+}
+
+// resetCounters does the clearCounters() job in the aggregator goroutine.
+func resetCounters() {
+	if aggOpts.clear && len(windows) != 0 {
+		endSample(snapshot()) // The sinks need the end of this sample.
+	}
 	sample++
 	//fmt.Printf("clearCounters %d\n", sample)
-	procInfos = map[int](*procInfo){}
+	// Keep the known processes and their ancestry (see cmdOf()), only the counters are new.
 	cmdInfos = map[string](*cmdInfo){}
-	if hist == true {
+	for _, pi := range procInfos {
+		pi.seen = false
+	}
+	if aggOpts.hist {
 		ehist = [32]uint64{} // execution time histogram
 	}
 	sampleStart = time.Now()
+	sampleBusy, _ = busyTime()
 	updateLongLivedStats(true) // Reset cpu counters for long lived processes.
 }
 
+// snapshot builds a report from the current counters. Must be called by the aggregator.
+func snapshot() *report {
+	r := &report{sampleStart: sampleStart, time: time.Now(), exitCount: exitCount, reusedCount: reusedCount, ehist: ehist, opts: aggOpts}
+	if b, err := busyTime(); err == nil && sampleBusy != 0 && b > sampleBusy {
+		r.busy = b - sampleBusy // Else unknown (0): /proc/stat could not be read or went backwards.
+	}
+	r.cmds = make([]cmdInfo, 0, len(cmdInfos))
+	for _, ci := range cmdInfos {
+		r.cmds = append(r.cmds, *ci)
+	}
+	if aggOpts.tree {
+		r.procs = procTree()
+	}
+	if aggOpts.alerts {
+		r.ancestry = cmdAncestries()
+	}
+	if aggOpts.parents {
+		for _, pi := range procInfos {
+			if pi.gen == sample && pi.cec+pi.cet != 0 {
+				n := procNode{pid: pi.pid, ppid: pi.ppid, cet: pi.cet, cec: pi.cec, parent: -1}
+				if pi.ci != nil {
+					n.cmd = pi.ci.cmd
+				}
+				r.parents = append(r.parents, n)
+			}
+		}
+	}
+	return r
+}
+
+// procTree returns all the processes counted in the current sample and their ancestors.
+func procTree() []procNode {
+	var ns []procNode
+	idx := map[*procInfo]int{}
+	var add func(pi *procInfo) int
+	add = func(pi *procInfo) int {
+		if i, known := idx[pi]; known {
+			return i
+		}
+		n := procNode{pid: pi.pid, ppid: pi.ppid, parent: -1}
+		if pi.ci != nil {
+			n.cmd = pi.ci.cmd
+		}
+		if pi.gen == sample {
+			n.et, n.ec, n.subet, n.subec = pi.et, pi.ec, pi.subet, pi.subec
+		}
+		i := len(ns)
+		idx[pi] = i // before walking up, a broken ppid chain could loop.
+		ns = append(ns, n)
+		if pi.ppi != nil {
+			ns[i].parent = add(pi.ppi)
+		}
+		return i
+	}
+	for _, pi := range procInfos {
+		if pi.gen == sample && pi.ec+pi.subec != 0 {
+			add(pi)
+		}
+	}
+	return ns
+}
+
+// liveTree returns all the known processes (their counters are the current sample ones).
+func liveTree() []procNode {
+	ns := make([]procNode, 0, len(procInfos))
+	idx := make(map[int]int, len(procInfos))
+	for _, pi := range procInfos {
+		n := procNode{pid: pi.pid, ppid: pi.ppid, parent: -1}
+		if pi.ci != nil {
+			n.cmd = pi.ci.cmd
+		} else {
+			n.cmd = pi.comm
+		}
+		if pi.gen == sample {
+			n.et, n.ec, n.subet, n.subec = pi.et, pi.ec, pi.subet, pi.subec
+		}
+		idx[pi.pid] = len(ns)
+		ns = append(ns, n)
+	}
+	for i := range ns {
+		if p, known := idx[ns[i].ppid]; known && p != i {
+			ns[i].parent = p
+		}
+	}
+	return ns
+}
+
 // Display the per command stats.
-func statsByCommand(ts int64, dts, dtus float64) {
+func statsByCommand(r *report, ts int64, dts, dtus float64) {
 	if raw {
 		if display == 0 {
 			fmt.Fprintf(out, "## top %d commands sorted by %s\n", top, scStrings[sortCriteria])
@@ -96,8 +296,8 @@ func statsByCommand(ts int64, dts, dtus float64) {
 	}
 	n := map[uint64][](*cmdInfo){}
 	var a UInt64Slice
-	mutInfos.Lock()
-	for _, ci := range cmdInfos {
+	for j := range r.cmds {
+		ci := &r.cmds[j]
 		var ui uint64
 		switch sortCriteria {
 		case scCount:
@@ -105,11 +305,10 @@ func statsByCommand(ts int64, dts, dtus float64) {
 		case scTime:
 			ui = ci.et
 		}
-		if ui != 0 {
+		if ui != 0 && shown(ci.cmd) {
 			n[ui] = append(n[ui], ci)
 		}
 	}
-	mutInfos.Unlock()
 	for k := range n {
 		a = append(a, k)
 	}
@@ -156,7 +355,7 @@ func statsByCommand(ts int64, dts, dtus float64) {
 }
 
 // Display stats about the comamnd and all its subprocesses (the whole tree).
-func statsSub(ts int64, dts, dtus float64) {
+func statsSub(r *report, ts int64, dts, dtus float64) {
 	if raw {
 		if display == 0 {
 			fmt.Fprintf(out, "## top %d commands sorted by sum of subprocesses %s\n", top, scStrings[sortCriteria])
@@ -167,8 +366,8 @@ func statsSub(ts int64, dts, dtus float64) {
 	}
 	n := map[uint64][](*cmdInfo){}
 	var a UInt64Slice
-	mutInfos.Lock()
-	for _, ci := range cmdInfos {
+	for j := range r.cmds {
+		ci := &r.cmds[j]
 		if ci.subec == 0 || ci.cmd == "" || ci.cmd == "init" || ci.cmd == "systemd" {
 			// No sub processes or we know that every process is sub of init, no need to mess stats with this one.
 			continue
@@ -180,11 +379,10 @@ func statsSub(ts int64, dts, dtus float64) {
 		case scTime:
 			ui = ci.subet
 		}
-		if ui != 0 {
+		if ui != 0 && shown(ci.cmd) {
 			n[ui] = append(n[ui], ci)
 		}
 	}
-	mutInfos.Unlock()
 	for k := range n {
 		a = append(a, k)
 	}
@@ -229,15 +427,191 @@ func statsSub(ts int64, dts, dtus float64) {
 	}
 }
 
+// statsTree displays the process instances with the biggest subtrees (own plus descendants), indented by ancestry.
+// A parent subtree always includes its children ones so keeping the top ones prunes the tree to its top branches.
+func statsTree(r *report, ts int64, dts, dtus float64) {
+	if raw {
+		if display == 0 {
+			fmt.Fprintf(out, "## top %d process tree branches sorted by subtree %s\n", top, scStrings[sortCriteria])
+			fmt.Fprintf(out, "## [time stamp s]:tree:[pid]:[ppid]:[depth]:[command]:[CPU percent]:[time usec]:[nb exec]:[subprocesses CPU percent]:[subprocesses time usec]:[subprocesses nb exec]:[subprocesses nb exec per s]\n")
+		}
+	} else {
+		printSep(out, " top %d process tree branches sorted by subtree %s ", top, scStrings[sortCriteria])
+	}
+	value := func(n *procNode) uint64 {
+		if sortCriteria == scCount {
+			return n.ec + n.subec
+		}
+		return n.et + n.subet
+	}
+	var order []int
+	for i := range r.procs {
+		if shown(r.procs[i].cmd) && value(&r.procs[i]) != 0 { // Idle subtrees (kworkers, ...) would fill the top.
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return value(&r.procs[order[i]]) > value(&r.procs[order[j]]) })
+	// Keep the top nodes and their ancestors (on ties a child may come before its parent).
+	keep := map[int]bool{}
+	for _, i := range order[:min(top, len(order))] {
+		for ; i >= 0 && !keep[i]; i = r.procs[i].parent {
+			keep[i] = true
+		}
+	}
+	children := map[int][]int{}
+	for i := range r.procs {
+		if keep[i] {
+			children[r.procs[i].parent] = append(children[r.procs[i].parent], i)
+		}
+	}
+	var show func(i, depth int)
+	show = func(i, depth int) {
+		n := &r.procs[i]
+		cmd := n.cmd
+		if cmd == "" {
+			cmd = "(vanished)"
+		}
+		etpc := cpuPercent(float64(n.et), dtus)
+		subetpc := cpuPercent(float64(n.subet), dtus)
+		if raw {
+			fmt.Fprintf(out, "%d:tree:%d:%d:%d:%s:%.2f:%d:%d:%.2f:%d:%d:%f\n", ts, n.pid, n.ppid, depth, cmd, etpc, n.et, n.ec, subetpc, n.subet, n.subec, float64(n.subec)/dts)
+		} else {
+			fmt.Fprintf(out, "%*s%d %s: %.2f%%et (%s) %dec   sub %.2f%%et (%s) %dec %.2fe/s\n", 2*depth, "", n.pid, cmd, etpc, time.Duration(n.et*1e3).String(), n.ec, subetpc, time.Duration(n.subet*1e3).String(), n.subec, float64(n.subec)/dts)
+		}
+		for _, c := range children[i] {
+			show(c, depth+1)
+		}
+	}
+	for _, i := range children[-1] {
+		show(i, 0)
+	}
+}
+
+// statsParents displays the live processes (not commands) with the busiest children: how many children each one spawned
+// and how much cpu they used. One runaway shell stands out here while statsSub merges it with all the other instances.
+func statsParents(r *report, ts int64, dts, dtus float64) {
+	if raw {
+		if display == 0 {
+			fmt.Fprintf(out, "## top %d parent processes sorted by children %s\n", top, scStrings[sortCriteria])
+			fmt.Fprintf(out, "## [time stamp s]:parent:[pid]:[command]:[children CPU percent]:[children time usec]:[nb children]:[nb children per s]\n")
+		}
+	} else {
+		printSep(out, " top %d parent processes sorted by children %s ", top, scStrings[sortCriteria])
+	}
+	var ps []procNode
+	for _, n := range r.parents {
+		if shown(n.cmd) {
+			ps = append(ps, n)
+		}
+	}
+	value := func(n *procNode) uint64 {
+		if sortCriteria == scCount {
+			return n.cec
+		}
+		return n.cet
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return value(&ps[i]) > value(&ps[j]) })
+	for i := range ps[:min(top, len(ps))] {
+		n := &ps[i]
+		cmd := n.cmd
+		if cmd == "" {
+			cmd = "(vanished)"
+		}
+		cetpc := cpuPercent(float64(n.cet), dtus)
+		ceps := float64(n.cec) / dts
+		dcet := time.Duration(n.cet * 1e3) // Duration is in ns
+		if raw {
+			fmt.Fprintf(out, "%d:parent:%d:%s:%.2f:%d:%d:%f\n", ts, n.pid, cmd, cetpc, n.cet, n.cec, ceps)
+		} else {
+			switch sortCriteria {
+			case scCount:
+				fmt.Fprintf(out, "%7d %15s: %d children %.2fe/s   %.2f%%et (%s)\n", n.pid, cmd, n.cec, ceps, cetpc, dcet.String())
+			case scTime:
+				fmt.Fprintf(out, "%7d %15s: %.2f%%et (%s)   %d children %.2fe/s\n", n.pid, cmd, cetpc, dcet.String(), n.cec, ceps)
+			}
+		}
+	}
+}
+
+// Display the share of CPU used by short lived processes (the ones a sampling tool like top would have missed).
+func statsLifetime(r *report, ts int64, dts, dtus float64) {
+	if raw {
+		if display == 0 {
+			fmt.Fprintf(out, "## top %d commands sorted by short lived %s\n", top, scStrings[sortCriteria])
+			fmt.Fprintf(out, "## [time stamp s]:life:[command]:[short lived CPU percent]:[short lived time usec]:[short lived nb exec]:[long lived CPU percent]:[long lived time usec]:[short lived percent of command time]\n")
+		}
+	} else {
+		printSep(out, " top %d commands sorted by short lived %s (missed by top) ", top, scStrings[sortCriteria])
+	}
+	n := map[uint64][](*cmdInfo){}
+	var a UInt64Slice
+	for j := range r.cmds {
+		ci := &r.cmds[j]
+		var ui uint64
+		switch sortCriteria {
+		case scCount:
+			ui = ci.slec
+		case scTime:
+			ui = ci.slet
+		}
+		if ui != 0 && shown(ci.cmd) {
+			n[ui] = append(n[ui], ci)
+		}
+	}
+	for k := range n {
+		a = append(a, k)
+	}
+	sort.Sort(sort.Reverse(a))
+	// Display sorted stats.
+	var i int
+	for _, k := range a {
+		for _, ci := range n[k] {
+			cmd := ci.cmd
+			if cmd == "" {
+				cmd = "(vanished)"
+			}
+			slet := ci.slet // *et in usec (microseconds 1e-6)
+			llet := ci.et - slet
+			sletpc := cpuPercent(float64(slet), dtus)
+			lletpc := cpuPercent(float64(llet), dtus)
+			var slpc float64 // share of this command time spent in short lived instances.
+			if ci.et != 0 {
+				slpc = 100 * float64(slet) / float64(ci.et)
+			}
+			var dslet = time.Duration(slet * 1e3) // Duration is in ns
+			var dllet = time.Duration(llet * 1e3)
+			if raw {
+				fmt.Fprintf(out, "%d:life:%s:%.2f:%d:%d:%.2f:%d:%.2f\n", ts, cmd, sletpc, slet, ci.slec, lletpc, llet, slpc)
+			} else {
+				fmt.Fprintf(out, "%15s: %.2f%%sl (%s, %d exits)   %.2f%%ll (%s)   %.0f%% short lived\n", cmd, sletpc, dslet.String(), ci.slec, lletpc, dllet.String(), slpc)
+			}
+			i++
+			if i > top {
+				return
+			}
+		}
+	}
+}
+
+// lifetimeShares returns the total accounted exec time and the part of it used by short lived processes. [in us]
+func lifetimeShares(r *report) (et, slet uint64) {
+	for j := range r.cmds {
+		ci := &r.cmds[j]
+		et += ci.et
+		slet += ci.slet
+	}
+	return et, slet
+}
+
 // Display the histogram for command execution time.
-func statsEHist(dts, dtus float64) {
+func statsEHist(r *report, dts, dtus float64) {
 	var firsti, lasti int
 	var s uint64 // sum of all values in the histogram.
 	firsti = -1
-	for l := 0; l < len(ehist); l++ {
-		if ehist[l] != 0 {
+	for l := 0; l < len(r.ehist); l++ {
+		if r.ehist[l] != 0 {
 			lasti = l
-			s += ehist[l]
+			s += r.ehist[l]
 			if firsti < 0 {
 				firsti = l // index of the first non 0 sample
 			}
@@ -247,7 +621,7 @@ func statsEHist(dts, dtus float64) {
 		// nothing in the histogram, skip its display.
 		return
 	}
-	printSep(out, " command execution time histogram (%d executed commands) ", exitCount)
+	printSep(out, " command execution time histogram (%d executed commands) ", r.exitCount)
 	fmt.Fprintf(out, "|")
 	p := 1
 	for l := 0; l <= lasti; l++ {
@@ -258,8 +632,8 @@ func statsEHist(dts, dtus float64) {
 	}
 	fmt.Fprintf(out, "\n|")
 	for l := firsti; l <= lasti; l++ {
-		if ehist[l] != 0 {
-			p5 := math.Ceil(float64(10000*ehist[l]) / float64(s))
+		if r.ehist[l] != 0 {
+			p5 := math.Ceil(float64(10000*r.ehist[l]) / float64(s))
 			pc := p5 / 100
 			pcs := strconv.FormatFloat(pc, 'f', -1, 64)
 			//pcs := fmt.Sprintf("%4f", pc)
@@ -272,13 +646,75 @@ func statsEHist(dts, dtus float64) {
 	fmt.Fprintf(out, "\n")
 }
 
-// Display a summary of gathered stats.
-func stats() {
-	// First update stats about all long lived processes.
+// stats displays a summary of the gathered stats. If reset is true the counters are cleared right after the report is taken.
+// Returns the number of displays done.
+func stats(reset bool) uint {
+	displayMu.Lock()
+	defer displayMu.Unlock()
+	r := getReport(reset)
+	switch {
+	case eventFmt != "":
+		// The output gets the exit records.
+	case dispFormat == "text" || dispFormat == "raw":
+		printReport(r)
+	default:
+		if err := encodeReport(out, dispFormat, display, r); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+	}
+	display++
+	if outf != nil && (rotateSize != 0 || rotateAge != 0) {
+		if err := outf.rotateIfDue(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+	}
+	return display
+}
+
+// dumpStats writes the stats to w in format (control socket). It does not count as a display.
+// Only a reset needs a sampling pass (the long lived processes cpu would be lost).
+func dumpStats(w io.Writer, format string, reset bool) error {
+	var r *report
+	if reset {
+		r = getReport(true)
+	} else {
+		r = peekReport()
+	}
+	return writeReport(w, format, 0, r) // 0 for the raw format comments and the csv header.
+}
+
+// getReport returns the report of the current sample (and resets the counters if reset).
+func getReport(reset bool) *report {
+	// The aggregator first updates stats about all long lived processes then sends back a report.
+	rc := make(chan *report)
+	aggReqs <- aggReq{op: aggStats, reset: reset, reply: rc}
+	return <-rc
+}
+
+// peekReport returns the report of the current sample without a sampling pass: the long lived processes cpu is
+// the one of the last display. For the sinks, the api and the status that must not change what the displays see.
+func peekReport() *report {
+	rc := make(chan *report)
+	aggReqs <- aggReq{op: aggSnapshot, reply: rc}
+	return <-rc
+}
+
+// printReportTo writes r to w in the raw or text format. n is the number of reports already written to w.
+func printReportTo(w io.Writer, rawFmt bool, n uint, r *report) {
+	displayMu.Lock()
+	defer displayMu.Unlock()
+	o, ra, d := out, raw, display
+	out, raw, display = w, rawFmt, n
+	printReport(r)
+	out, raw, display = o, ra, d
+}
+
+// printReport writes r to out. displayMu must be held.
+func printReport(r *report) {
 	getTermDimensions() // Update the term width every display.
-	t := time.Now().Unix()
-	dt := time.Since(sampleStart)
-	updateLongLivedStats(false) // Get cpu usage for long lived processes since last sample.
+	t := r.time.Unix()
+	dt := r.time.Sub(r.sampleStart)
+	busy := r.busy
 	dts := dt.Seconds()
 	dtus := dts * 1e6 // us is mucriseconds 1e-6
 	var pref string
@@ -289,65 +725,112 @@ func stats() {
 	}
 	hn, _ := os.Hostname()
 	fmt.Fprintf(out, "%shostname:           %s\n", pref, hn)
-	fmt.Fprintf(out, "%sdate:               %s\n", pref, time.Now())
+	fmt.Fprintf(out, "%sdate:               %s\n", pref, r.time)
 	fmt.Fprintf(out, "%scpus:               %d\n", pref, cpuNb)
+	if probe != nil {
+		var na []string
+		for _, f := range taskstats.Features() {
+			if !probe.Has(f) {
+				na = append(na, f.String())
+			}
+		}
+		if len(na) == 0 {
+			na = append(na, "none")
+		}
+		fmt.Fprintf(out, "%staskstats:          version %d, unavailable fields: %s\n", pref, probe.Version, strings.Join(na, " "))
+	}
 	fmt.Fprintf(out, "%ssample duration:    %s\n", pref, time.Duration.String(dt))
-	fmt.Fprintf(out, "%sexit count:         %d (%.2fe/s)\n", pref, exitCount, float32(exitCount)/float32(dts))
-	fmt.Fprintf(out, "%snumber of comamnds: %d\n", pref, len(cmdInfos))
+	fmt.Fprintf(out, "%sexit count:         %d (%.2fe/s)\n", pref, r.exitCount, float32(r.exitCount)/float32(dts))
+	fmt.Fprintf(out, "%snumber of comamnds: %d\n", pref, len(r.cmds))
+	fmt.Fprintf(out, "%spid reuses:         %d detected since start\n", pref, r.reusedCount)
+	aet, slet := lifetimeShares(r)
+	var slpc float64
+	if aet != 0 {
+		slpc = 100 * float64(slet) / float64(aet)
+	}
+	fmt.Fprintf(out, "%sshort lived cpu:    %.2f%% of accounted cpu (%s, missed by top)\n", pref, slpc, time.Duration(slet*1e3).String())
+	if len(exitConns) != 0 {
+		var drops uint64
+		for _, c := range exitConns {
+			d, _ := netlinkDrops(c.Inode())
+			drops += d
+		}
+		fmt.Fprintf(out, "%snetlink drops:      %d lost exit events (%d overflows, %d queue full, %d sockets) since start\n", pref, drops, atomic.LoadInt64(&exitOverflows), atomic.LoadUint64(&evqDrops), len(exitConns))
+	}
+	if forkConn != nil {
+		drops, _ := netlinkDrops(forkConn.Inode())
+		fmt.Fprintf(out, "%sfork events drops:  %d lost fork events (%d overflows) since start\n", pref, drops, atomic.LoadInt64(&forkOverflows))
+	}
+	if busy != 0 {
+		// Busy cpu time we could not attribute to a process: lost events, interrupts, vanished processes, ...
+		uet := int64(busy) - int64(aet)
+		fmt.Fprintf(out, "%saccounted cpu:      %.2f%% of busy cpu (%s of %s), unaccounted: %s\n", pref, 100*float64(aet)/float64(busy), time.Duration(aet*1e3).String(), time.Duration(busy*1e3).String(), time.Duration(uet*1e3).String())
+	}
 
 	if top > 0 {
-		statsByCommand(t, dts, dtus)
+		statsByCommand(r, t, dts, dtus)
 	}
 	if !raw && hist {
-		statsEHist(dts, dtus)
+		statsEHist(r, dts, dtus)
 	}
 	if top > 0 {
-		statsSub(t, dts, dtus)
+		statsSub(r, t, dts, dtus)
+		if tree {
+			statsTree(r, t, dts, dtus)
+		}
+		if parents {
+			statsParents(r, t, dts, dtus)
+		}
+		statsLifetime(r, t, dts, dtus)
 	}
 	printSep(out, "")
-	display++
 }
 
-// readProcStats Extract the command (and ppid) from /proc/[pid]/stat
-func readProcStat(pid int) (string, int) {
+// readProcStats Extract the command, ppid and start time [sec since 1970] from /proc/[pid]/stat
+func readProcStat(pid int) (string, int, uint64) {
 	fn := fmt.Sprintf("/proc/%d/stat", pid)
 	s, err := fastRead(fn)
 	sl := len(s)
 	if err != nil || sl == 0 {
 		vanishedCount++
-		return "", -1
+		return "", -1, 0
+	}
+	// 1 tcomm is between parenthesis and may contain spaces or ')', it ends at the last ')'.
+	ob := findNextIndex(s, 0, '(')
+	cb := bytes.LastIndexByte(s, ')')
+	if cb < ob {
+		return "", -1, 0
 	}
-	var f int // field number (0 is pid)
-	var i64 int64
-	var cmd string
-	for i := 0; i < sl; i++ {
-		//fmt.Fprintf(out,"f:%d i:%d c:%c\n", f, i, s[i])
+	cmd := string(s[ob+1 : cb])
+	var ppid, st int64
+	// Assume one and only one ' '  between fields.
+	for f, i := 2, cb+2; f <= 21 && i < sl; f++ { // f: field number (0 is pid)
 		switch f {
-		case 1: // 1 tcomm
-			i++ // Skip the '('.
-			cmd, i = fastParseUntil(s, i, ')')
 		case 3: // 3 ppid
-			i64, i = fastParseInt(s, i)
-			return cmd, int(i64)
+			ppid, i = fastParseInt(s, i)
+		case 21: // 21 starttime [clock ticks since boot]
+			st, i = fastParseInt(s, i)
 		default: // Skip this field.
-			i++
-			for ; i < sl; i++ {
-				if s[i] == ' ' {
-					break
-				}
-			}
+			i = findNextIndex(s, i, ' ')
 		}
-		// Assume one and only one ' '  between fields.
-		f++
+		i++
 	}
-	return "", -1
+	return cmd, int(ppid), bootTime + uint64(st)/clkTck
+}
+
+// sameStart tells if two start times [sec since 1970] may belong to the same process (0 is unknown).
+// taskstats and /proc compute the start time differently so they can differ by a second.
+func sameStart(a, b uint64) bool {
+	return a == 0 || b == 0 || (a <= b+1 && b <= a+1)
 }
 
-// Global to avoid passing to C and back. Does this update phase need to init cpu counters?
-// Used only by goUpdateStats() => only in ont thread.
-var initCpuCounters bool
+// startedBefore tells if a process started at pstart may be the parent of a process started at cstart (0 is unknown).
+func startedBefore(pstart, cstart uint64) bool {
+	return pstart == 0 || cstart == 0 || pstart <= cstart+1
+}
 
 // Update stats for long lived processes foundin /proc
+// init tells if this update phase (re)inits cpu counters.
 func updateLongLivedStats(init bool) error {
 	// Get all new proicesses
 	d, err := os.Open("/proc/")
@@ -370,10 +853,10 @@ func updateLongLivedStats(init bool) error {
 			// If not numeric name then skip.
 			continue
 		}
-		// This will send a request for stats then read all waiting asnwers.
-		// Every answer will trigger a call to GO function goUpdateStats()
-		initCpuCounters = init
-		C.request_pid_stats(C.__u32(pid))
+		// This will send a request for stats then read the answer.
+		if st, err := qconn.PID(int(pid)); err == nil {
+			updateStats(int(st.PID), int(st.PPID), st.UTime+st.STime, st.Comm, st.StartTime(), init)
+		}
 	}
 	return nil
 }
@@ -381,7 +864,6 @@ func updateLongLivedStats(init bool) error {
 // Remove all dead processes from the global procInfos map.
 // The exit event callback should handle this but in some cases we may miss events.
 func cleanProcInfos() {
-	mutInfos.Lock()
 	for pid := range procInfos {
 		process, _ := os.FindProcess(pid) // On UNIX always success.
 		err := process.Signal(syscall.Signal(0))
@@ -390,7 +872,6 @@ func cleanProcInfos() {
 			removedCount++
 		}
 	}
-	mutInfos.Unlock()
 }
 
 // incCmd increment command counters (cpu, execution count) in cmdInfos (create new entry if need be)
@@ -409,63 +890,170 @@ func incCmd(ci *cmdInfo, cmd string, et uint64, ec uint64) *cmdInfo {
 	return ci
 }
 
-// propagateStats walk up the pid chain and add cpu and execution count to parent commands.
-func propagateStats(spid int, pi *procInfo, pid int, et uint64, ec uint64) *procInfo {
-	//fmt.Printf("propagateStats: pi:%v pid:%d cpu:%d ec:%d\n", pi, pid, cpu, ec)
+// incShortLived accounts an exited process that no sampling pass saw alive in its command short lived counters.
+func incShortLived(ci *cmdInfo, et uint64) {
+	ci.slec++
+	ci.slet += et
+}
+
+// The exec time distribution of a command has 4 buckets per power of 2 (19% wide) up to 2^32us (71m).
+const xhistSize = 128
+
+// xhistIndex returns the bucket of exec time et [in us].
+func xhistIndex(et uint64) int {
+	return min(int(4*math.Log2(float64(et+1))), xhistSize-1)
+}
+
+// percentile returns the p percentile of the exec time [in us] of the exited instances of ci (0 if none).
+// It is the middle of the bucket where it lies.
+func (ci *cmdInfo) percentile(p float64) uint64 {
+	var n uint64
+	for _, c := range ci.xhist {
+		n += uint64(c)
+	}
+	if n == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p * float64(n) / 100))
+	var s uint64
+	for i, c := range ci.xhist {
+		s += uint64(c)
+		if s >= rank && c != 0 {
+			return uint64(math.Exp2((float64(i)+0.5)/4) - 1)
+		}
+	}
+	return 0
+}
+
+// cmdFor returns the counters of command cmd (created if need be).
+func cmdFor(cmd string) *cmdInfo {
+	ci, known := cmdInfos[cmd]
+	if !known {
+		ci = &cmdInfo{cmd: cmd}
+		cmdInfos[cmd] = ci
+	}
+	return ci
+}
+
+// cmdOf returns the command counters of pi for the current sample.
+// resetCounters replaces all the counters so a link made during a previous sample is renewed here (and the instance counters cleared).
+func cmdOf(pi *procInfo) *cmdInfo {
+	if pi.gen != sample {
+		if pi.ci != nil {
+			pi.ci = cmdFor(pi.ci.cmd)
+		}
+		pi.et, pi.ec, pi.subet, pi.subec, pi.cet, pi.cec = 0, 0, 0, 0, 0, 0
+		pi.gen = sample
+	}
+	return pi.ci
+}
+
+// setCmd links pi to its command counters.
+func setCmd(pi *procInfo, ci *cmdInfo) {
+	pi.ci = ci
+	pi.gen = sample
+}
+
+// reparent records ppid, the current parent of pi.
+// With the original ancestry the first known parent (the one at fork time when we got the fork event) is kept,
+// so the processes of a daemonizing script are still credited to it instead of init or a subreaper.
+func reparent(pi *procInfo, ppid int) {
+	if ppid == pi.ppid || (origAncestry && pi.ppid > 0) {
+		return
+	}
+	pi.ppid = ppid
+	pi.ppi = nil // Found again on the next walk up.
+}
+
+// parentInfo returns the info of process pid, parent of a process started at cstart (create it from /proc if need be).
+// Returns nil if we walked up to init or if pid was recycled (the parent is gone).
+func parentInfo(pid int, cstart uint64) *procInfo {
 	if pid <= 1 {
 		// walked up to init process (pid==0)
 		return nil
 	}
-	if pi == nil {
-		// Is this PID already known?
-		pi, _ = procInfos[pid]
+	// Is this PID already known?
+	pi, _ := procInfos[pid]
+	if pi != nil && !startedBefore(pi.start, cstart) {
+		// The known process started after the child: the parent is gone and its pid was recycled.
+		reusedCount++
+		delete(procInfos, pid)
+		pi = nil
 	}
 	if pi == nil {
 		// First time we see this pid.
-		cmd, ppid := readProcStat(pid)
+		cmd, ppid, start := readProcStat(pid)
+		cmd = groupOf(cmd)
 		//fmt.Printf("read /proc %d: %s %d\n", pid, cmd, ppid)
-		pi = &procInfo{pid: pid, ppid: ppid}
+		if !startedBefore(start, cstart) {
+			// Recycled pid, this is not the parent. Stop here rather than credit the wrong process.
+			reusedCount++
+			return nil
+		}
+		pi = &procInfo{pid: pid, ppid: ppid, start: start}
 		procInfos[pid] = pi
-		var ci *cmdInfo
-		var known bool
-		if ci, known = cmdInfos[cmd]; !known {
-			ci = &cmdInfo{cmd: cmd}
-			cmdInfos[cmd] = ci
+		setCmd(pi, cmdFor(cmd))
+	}
+	return pi
+}
+
+// propagateStats walk up the pid chain and add cpu and execution count to parent commands.
+// cstart is the start time of the child of pid, used to detect a recycled parent pid.
+func propagateStats(spid int, pi *procInfo, pid int, et uint64, ec uint64, cstart uint64) *procInfo {
+	//fmt.Printf("propagateStats: pi:%v pid:%d cpu:%d ec:%d\n", pi, pid, cpu, ec)
+	if pid <= 1 {
+		// walked up to init process (pid==0)
+		return nil
+	}
+	if pi == nil {
+		if pi = parentInfo(pid, cstart); pi == nil {
+			return nil
 		}
-		pi.ci = ci
 	}
-	if pi.ci != nil {
+	if ci := cmdOf(pi); ci != nil {
 		// We are walking up the ppid chain. The increments are for sub commands.
-		if spid != pi.ci.spid {
-			pi.ci.subec += ec
-			pi.ci.subet += et
-			pi.ci.spid = spid
+		if spid != ci.spid {
+			ci.subec += ec
+			ci.subet += et
+			ci.spid = spid
 		}
 	}
+	pi.subec += ec
+	pi.subet += et
 	if pi.ppid != 0 {
 		if pi.ppi != nil {
-			propagateStats(spid, pi.ppi, pi.ppid, et, ec)
+			propagateStats(spid, pi.ppi, pi.ppid, et, ec, pi.start)
 		} else {
-			pi.ppi = propagateStats(spid, nil, pi.ppid, et, ec)
+			pi.ppi = propagateStats(spid, nil, pi.ppid, et, ec, pi.start)
 		}
 	}
 
 	return pi
 }
 
-//export goUpdateStats
-// This method is called from C every time a process stats is read (after a request for update).
-func goUpdateStats(cpid, cppid C.int, ccpu C.ulong, ccmd *C.char) {
-	pid := int(cpid)
-	ppid := int(cppid)
-	cpu := uint64(ccpu)
-	cmd := C.GoString(ccmd)
-	mutInfos.Lock()
+// childStats credits pi, the parent of a process, with this process exec time and execution count.
+func childStats(pi *procInfo, et uint64, ec uint64) {
+	if pi != nil {
+		pi.cet += et
+		pi.cec += ec
+	}
+}
+
+// updateStats is called every time a process stats is read (after a request for update).
+// start is the process start time [sec since 1970].
+func updateStats(pid, ppid int, cpu uint64, cmd string, start uint64, init bool) {
 	var det uint64
+	cmd = groupOf(cmd)
 	pi, known := procInfos[pid]
-	if known {
+	if known && !sameStart(pi.start, start) {
+		// The pid was recycled since we last saw it: forget the previous process (its command, cpu and parent).
+		reusedCount++
+		delete(procInfos, pid)
+		known = false
+	}
+	if known && pi.seen {
 		// Usual case, we request mostly long lived processes so they are already known.
-		if initCpuCounters == true {
+		if init {
 			// New sample => (re)init cpu counters for all long lived processes.clear
 			det = 0
 		} else if cpu >= pi.cpu {
@@ -475,58 +1063,132 @@ func goUpdateStats(cpid, cppid C.int, ccpu C.ulong, ccmd *C.char) {
 			// very rare overflow. TODO compute the exact overflow not only the wrap around part?
 			det = cpu
 		}
-		pi.ci = incCmd(pi.ci, cmd, det, 0)
-		pi.ppi = propagateStats(pid, pi.ppi, ppid, det, 0)
+		setCmd(pi, incCmd(cmdOf(pi), cmd, det, 0))
+		pi.et += det
+		reparent(pi, ppid)
+		pi.ppi = propagateStats(pid, pi.ppi, pi.ppid, det, 0, start)
+		childStats(pi.ppi, det, 0)
 		pi.cpu = cpu // new reference cpu counter.
+		pi.start = start
 	} else {
-		// First time we see this process.
-		pi = &procInfo{pid: pid, ppid: ppid, cpu: cpu}
-		procInfos[pid] = pi
-		if initCpuCounters == true {
-			// (re)init cpu counters for all long lived processes.
+		// First time a sampling pass sees this process (it may be known from its fork event or as a parent).
+		if known {
+			reparent(pi, ppid)
+		} else {
+			pi = &procInfo{pid: pid, ppid: ppid}
+			procInfos[pid] = pi
+		}
+		var cec uint64 // 1 if this is a new child of its parent.
+		if init {
+			// (re)init cpu counters for all long lived processes. They were already there, not spawned in this sample.
 			det = 0
 		} else {
 			det = cpu // this process was not here at the start of the sample. count all its cpu for this sample.
+			cec = 1
 		}
-		pi.ci = incCmd(nil, cmd, det, 1)
-		pi.ppi = propagateStats(pid, nil, ppid, det, 1)
+		setCmd(pi, incCmd(cmdOf(pi), cmd, det, 1))
+		pi.ci.ppid = pi.ppid
+		pi.et += det
+		pi.ec++
+		pi.ppi = propagateStats(pid, pi.ppi, pi.ppid, det, 1, start)
+		childStats(pi.ppi, det, cec)
 		pi.cpu = cpu
+		pi.seen = true
+		pi.start = start
+	}
+}
+
+// forkStats is called for every fork event. It records the new process and its parent before it can be reparented.
+// start is the process start time [sec since 1970].
+func forkStats(pid, ppid int, start uint64) {
+	if pi, known := procInfos[pid]; known {
+		if sameStart(pi.start, start) {
+			return // Already known (a sampling pass was faster than the fork event).
+		}
+		// We knew a previous process with this pid, it is gone.
+		reusedCount++
+	}
+	pi := &procInfo{pid: pid, ppid: ppid, start: start}
+	procInfos[pid] = pi
+	pi.ppi = parentInfo(ppid, start) // The parent is alive now, it may not be later.
+	if eventFmt != "" && pi.ppi != nil && pi.ppi.ci == nil && pi.ppi.comm == "" {
+		// The parent is only known from its own fork event: name it while it runs for the exit records ancestry
+		// (its children often exit before it).
+		if cmd, _, pstart := readProcStat(ppid); cmd != "" && sameStart(pi.ppi.start, pstart) {
+			pi.ppi.comm = cmd
+		}
 	}
-	mutInfos.Unlock()
 }
 
-//export goExitStats
-// This method is called from C every time a process exists and sends its stats on the netlink socket.
+// exitStats is called for every exit event popped from the events queue (a process exited and its stats were sent on a netlink socket).
 // cpu is the sum of system and user execution time in usec (from taskstat ac_utime+ac_stime)
-func goExitStats(cpid, cppid C.int, ccpu C.ulong, ccmd *C.char) {
+// start is the process start time [sec since 1970].
+// Returns the counters of the command of the process.
+func exitStats(pid, ppid int, cpu uint64, cmd string, start uint64) *cmdInfo {
 	exitCount++
-	pid := int(cpid)
-	ppid := int(cppid)
-	cpu := uint64(ccpu)
-	cmd := C.GoString(ccmd)
+	cmd = groupOf(cmd)
 	//fmt.Fprintf(out, "Exit Stats: pid=%d ppid=%d uid=%d cpu=%d cmd=%s\n", pid, ppid, uid, cpu, cmd)
 	// We update histogram only on exit (not on update)
-	if ccpu == 0 {
-		ccpu++ // avoid log(0)
-	}
-	if hist == true {
-		i := int(math.Log10(float64(ccpu)))
-		//fmt.Printf("cpu:%d i:%d\n", ccpu, i)
+	if aggOpts.hist || httpAddr != "" {
+		hcpu := cpu
+		if hcpu == 0 {
+			hcpu++ // avoid log(0)
+		}
+		i := int(math.Log10(float64(hcpu)))
+		//fmt.Printf("cpu:%d i:%d\n", hcpu, i)
 		ehist[i]++
 	}
-	mutInfos.Lock()
-	if pi, known := procInfos[pid]; !known {
+	pi, known := procInfos[pid]
+	if known && !sameStart(pi.start, start) {
+		// We knew a previous process with this pid, it is gone.
+		reusedCount++
+		delete(procInfos, pid)
+		known = false
+	}
+	if !known {
 		// Usual case where this exit event is the first time we see this pid.
-		incCmd(nil, cmd, cpu, 1)
-		propagateStats(pid, nil, ppid, cpu, 1)
-	} else {
-		// Sometimes we already have created this pid when walking up the ppid chain.
+		// It lived and died between two sampling passes: short lived.
+		ci := incCmd(nil, cmd, cpu, 1)
+		ci.ppid = ppid
+		incShortLived(ci, cpu)
+		childStats(propagateStats(pid, nil, ppid, cpu, 1, start), cpu, 1)
+		return ci
+	} else if !pi.seen {
+		// Sometimes we already have created this pid from its fork event or when walking up the ppid chain.
 		// TODO handle out of order exits with ungathered stats?
 		delete(procInfos, pid)
-		incCmd(pi.ci, cmd, cpu, 1)
-		propagateStats(pid, pi.ppi, ppid, cpu, 1)
+		ci := incCmd(cmdOf(pi), cmd, cpu, 1)
+		incShortLived(ci, cpu)
+		setCmd(pi, ci) // Its children may still show it in the process tree.
+		reparent(pi, ppid)
+		ci.ppid = pi.ppid
+		pi.et += cpu
+		pi.ec++
+		childStats(propagateStats(pid, pi.ppi, pi.ppid, cpu, 1, start), cpu, 1)
+		return ci
+	}
+	// Long lived process: its execution was counted and its cpu accounted up to the last sampling pass.
+	delete(procInfos, pid)
+	var det uint64
+	if cpu >= pi.cpu {
+		det = cpu - pi.cpu
 	}
-	mutInfos.Unlock()
+	ci := incCmd(cmdOf(pi), cmd, det, 0)
+	pi.et += det
+	reparent(pi, ppid)
+	childStats(propagateStats(pid, pi.ppi, pi.ppid, det, 0, start), det, 0)
+	return ci
+}
+
+// exitInfo accounts the user, memory, I/O and exec time of an exited process in the counters of its command ci.
+func exitInfo(ci *cmdInfo, ev *exitEvent) {
+	ci.uid = ev.uid
+	if ev.rss > ci.rss {
+		ci.rss = ev.rss
+	}
+	ci.rd += ev.rd
+	ci.wr += ev.wr
+	ci.xhist[xhistIndex(ev.cpu)]++
 }
 
 func initNetlink() error {
@@ -534,25 +1196,89 @@ func initNetlink() error {
 	syscall.Setpriority(syscall.PRIO_PROCESS, 0, -20)
 
 	// Prepare a netlink socket where we will ask for stats.
-	rc := C.init_tgid_stats()
-	if rc != 0 {
-		return fmt.Errorf("Fatal error with the Netlink socket (%s).\n Remember that you need to have root permissions to use netlink sockets.\n", C.GoString(C.error_msg()))
-	}
-	// This C function will connect to the kernel and wait for all events.
-	// Events will be handled by callbacks in go. (see goProcEvent* functions above(.
-	rc = C.init_nlstats()
-	if rc != 0 {
-		return fmt.Errorf("Fatal error with the Netlink socket (%s).\n Remember that you need to have root permissions to use netlink sockets.\n", C.GoString(C.error_msg()))
+	var err error
+	qconn, err = taskstats.Dial()
+	if err != nil {
+		return fmt.Errorf("Fatal error with the Netlink socket (%s).\n Remember that you need to have root permissions to use netlink sockets.\n", err)
 	}
 	return nil
 }
 
-// Get process events directly from the Linux kernel (via tne netlink. No lag, no missed events, ... Far superior to any scan based algorithm but not portable.
-func getExitStats() error {
-	// Blocking call that will handle netlink events and call back go when a process exit stats are available.
-	rc := C.get_exit_stats()
-	if rc != 0 {
-		return fmt.Errorf("Fatal error with the Netlink socket (%s).\n Remember that you need to have root permissions to use netlink sockets.\n", C.GoString(C.error_msg()))
+// aggregate is the aggregator goroutine loop. It owns cmdInfos, procInfos and the counters.
+// Process exit events come directly from the Linux kernel (via tne netlink. No lag, no missed events, ... Far superior to any scan based algorithm but not portable.
+// The CPUs are split in groups of group CPUs (0 for one group with all CPUs). Every group has its own socket read by its own listener that only queues events.
+// This goroutine is the single consumer of these events and also serves the aggReqs requests.
+func aggregate(group int) error {
+	err := startExitStats(group)
+	if err != nil {
+		return fmt.Errorf("Fatal error with the Netlink socket (%s).\n Remember that you need to have root permissions to use netlink sockets.\n", err)
+	}
+	if origAncestry {
+		// Fork events tell the original parent of processes that will be reparented.
+		if err = startForkStats(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: no fork events (%s), the original parent of a process is the first one we see.\n", err)
+		}
+	}
+	// Init cpu counters for all current processes (to get long lived ones).
+	updateLongLivedStats(true)
+	var evs [256]exitEvent
+	for {
+		n := evqPop(evs[:])
+		for i := 0; i < n; i++ {
+			ev := &evs[i]
+			switch ev.kind {
+			case evExit:
+				var pi *procInfo
+				if eventFmt != "" {
+					pi = procInfos[ev.pid] // Gone after exitStats.
+				}
+				exitInfo(exitStats(ev.pid, ev.ppid, ev.cpu, ev.cmd, ev.start), ev)
+				if eventFmt != "" {
+					streamExit(ev, pi)
+				}
+			case evFork:
+				forkStats(ev.pid, ev.ppid, ev.start)
+			}
+		}
+		if n != 0 {
+			select {
+			case r := <-aggReqs:
+				serve(r)
+			default:
+			}
+			continue
+		}
+		if atomic.LoadInt64(&exitListeners) == 0 {
+			return fmt.Errorf("Fatal error with the Netlink socket (%s).\n", exitError())
+		}
+		// Queue is empty, wait for a request or for a listener to push an event.
+		select {
+		case r := <-aggReqs:
+			serve(r)
+		case <-evqWake:
+		}
+	}
+}
+
+// serve handles a request in the aggregator goroutine.
+func serve(r aggReq) {
+	switch r.op {
+	case aggStats:
+		updateLongLivedStats(false) // Get cpu usage for long lived processes since last sample.
+		r.reply <- snapshot()
+		if r.reset {
+			resetCounters()
+		}
+	case aggSnapshot:
+		r.reply <- snapshot()
+	case aggClear:
+		resetCounters()
+	case aggClean:
+		cleanProcInfos()
+	case aggSettings:
+		setGroups(r.groups)
+		aggOpts = r.opts
+	case aggTree:
+		r.reply <- &report{sampleStart: sampleStart, time: time.Now(), procs: liveTree()}
 	}
-	return nil
 }
@@ -0,0 +1,156 @@
+package main
+
+/* StatsD and Graphite sinks.
+* -O statsd:[interval]:[host:port] sends counters and gauges over UDP, -O graphite:[interval]:[host:port] sends the
+* plaintext protocol over TCP. Metrics are named topfast.[host].[command].[metric], the host and command parts are
+* sanitized (anything but letters, digits, - and _ becomes _).
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Formats of the push sinks (only for -O, the destination is host:port or a socket path).
+var pushFormats = map[string]bool{"statsd": true, "graphite": true, "syslog": true, "journald": true}
+
+const statsdPacket = 1432 // biggest statsd datagram (fits an ethernet frame).
+
+// metricPart sanitizes s for a metric name part.
+func metricPart(s string) string {
+	if s == "" {
+		return "_vanished_"
+	}
+	return strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+			return c
+		}
+		return '_'
+	}, s)
+}
+
+// metricPrefix returns the prefix of all the metric names.
+func metricPrefix() string {
+	hn, _ := os.Hostname()
+	return "topfast." + metricPart(hn) + "."
+}
+
+// pushSink sends the reports to a StatsD (UDP) or Graphite (TCP) server.
+type pushSink struct {
+	format string
+	addr   string
+	conn   net.Conn // statsd socket.
+	last   *report  // last report sent (statsd counters are the increments since then).
+}
+
+func newPushSink(format, addr string) (Sink, error) {
+	s := &pushSink{format: format, addr: addr}
+	if format == "statsd" {
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	return s, nil
+}
+
+func (s *pushSink) Write(r *report) error {
+	if s.format == "statsd" {
+		return s.statsd(r)
+	}
+	return s.graphite(r)
+}
+
+// statsd sends the per command exec time and count as counters and the cpu and rates as gauges.
+func (s *pushSink) statsd(r *report) error {
+	d, exits := r, r.exitCount // The counters must be increments.
+	if !r.opts.clear && s.last != nil {
+		exits -= s.last.exitCount // exitCount is never reset.
+		if s.last.sampleStart.Equal(r.sampleStart) {
+			d = r.sub(s.last)
+		}
+	}
+	s.last = r
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	pref := metricPrefix()
+	var b bytes.Buffer
+	var err error
+	send := func(format string, a ...interface{}) {
+		m := fmt.Sprintf(format, a...)
+		if b.Len() != 0 && b.Len()+1+len(m) > statsdPacket {
+			if _, e := s.conn.Write(b.Bytes()); e != nil {
+				err = e
+			}
+			b.Reset()
+		}
+		if b.Len() != 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(m)
+	}
+	send("%sexits:%d|c", pref, exits)
+	send("%sexit_rate:%f|g", pref, float64(r.exitCount)/dts)
+	rates := map[string]*cmdInfo{}
+	for _, ci := range sortedCmds(r) {
+		rates[ci.cmd] = ci
+	}
+	for _, ci := range sortedCmds(d) {
+		p := pref + metricPart(ci.cmd) + "."
+		send("%set:%d|c", p, ci.et)
+		send("%sec:%d|c", p, ci.ec)
+		send("%ssubet:%d|c", p, ci.subet)
+		send("%ssubec:%d|c", p, ci.subec)
+		if rc := rates[ci.cmd]; rc != nil {
+			send("%scpu:%f|g", p, cpuPercent(float64(rc.et), dts*1e6))
+			send("%srate:%f|g", p, float64(rc.ec)/dts)
+		}
+	}
+	if b.Len() != 0 {
+		if _, e := s.conn.Write(b.Bytes()); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// graphite sends the exec time, count, cpu and rate of every command and of its subprocesses with the report time.
+func (s *pushSink) graphite(r *report) error {
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	dtus := dts * 1e6
+	ts := r.time.Unix()
+	pref := metricPrefix()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%sexits %d %d\n", pref, r.exitCount, ts)
+	fmt.Fprintf(&b, "%sexit_rate %f %d\n", pref, float64(r.exitCount)/dts, ts)
+	for _, ci := range sortedCmds(r) {
+		p := pref + metricPart(ci.cmd) + "."
+		fmt.Fprintf(&b, "%set %d %d\n", p, ci.et, ts)
+		fmt.Fprintf(&b, "%sec %d %d\n", p, ci.ec, ts)
+		fmt.Fprintf(&b, "%scpu %f %d\n", p, cpuPercent(float64(ci.et), dtus), ts)
+		fmt.Fprintf(&b, "%srate %f %d\n", p, float64(ci.ec)/dts, ts)
+		if ci.subec != 0 {
+			fmt.Fprintf(&b, "%ssubet %d %d\n", p, ci.subet, ts)
+			fmt.Fprintf(&b, "%ssubec %d %d\n", p, ci.subec, ts)
+		}
+	}
+	c, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write(b.Bytes())
+	return err
+}
+
+func (s *pushSink) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,460 @@
+package main
+
+/* Output sinks.
+* Besides the main display (-o or stdout), every -O adds a sink with its own format, interval and destination.
+* With -c the main display resets the counters, so every sink adds up the ends of the samples and the current one to
+* get the stats of its own interval (see window).
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neoliv/topfast/taskstats"
+)
+
+// Sink is an output for the reports.
+type Sink interface {
+	// Write outputs r. r covers the sink interval with -c or since the last reset without.
+	Write(r *report) error
+	Close() error
+}
+
+// alertSink is a sink that also gets the alerts.
+type alertSink interface {
+	Alert(a *alert) error
+}
+
+var alertSinks []alertSink
+
+// sinkSpec is a -O value: [format]:[interval]:[destination]. The destination of the push formats is host:port.
+type sinkSpec struct {
+	format   string
+	interval time.Duration
+	dest     string
+}
+
+// detachedSink tells if a sink writes somewhere else than stdout (useful in daemon mode).
+func detachedSink() bool {
+	for _, sp := range sinkSpecs {
+		if !formats[sp.format] || (sp.dest != "" && sp.dest != "-") {
+			return true
+		}
+	}
+	return false
+}
+
+// sinkList is a flag that can be repeated, every value is a sink.
+type sinkList []sinkSpec
+
+var sinkSpecs sinkList
+
+// Known formats.
+var formats = map[string]bool{"text": true, "raw": true, "json": true, "csv": true, "tsv": true, "influx": true}
+
+func (l *sinkList) String() string {
+	var a []string
+	for _, s := range *l {
+		a = append(a, fmt.Sprintf("%s:%s:%s", s.format, s.interval, s.dest))
+	}
+	return strings.Join(a, " ")
+}
+
+func (l *sinkList) Set(s string) error {
+	p := strings.SplitN(s, ":", 3)
+	if len(p) != 3 {
+		return fmt.Errorf("bad sink '%s', use [format]:[interval]:[destination]", s)
+	}
+	if !formats[p[0]] && !pushFormats[p[0]] {
+		return fmt.Errorf("unknown format '%s' in sink '%s'", p[0], s)
+	}
+	d, err := time.ParseDuration(p[1])
+	if err != nil || d <= 0 {
+		return fmt.Errorf("bad interval '%s' in sink '%s'", p[1], s)
+	}
+	*l = append(*l, sinkSpec{p[0], d, p[2]})
+	return nil
+}
+
+// window builds the report of a sink interval across the samples ended by the main display resets.
+type window struct {
+	mu    sync.Mutex
+	last  *report   // last report of the current sample (nil at the start of a sample).
+	acc   *report   // the ends of the samples since the last write.
+	start time.Time // start of the interval.
+	exits uint64    // exit count (since start) at the start of the interval.
+}
+
+var windows []*window
+var windowsMu sync.Mutex
+
+// endSample is called by the aggregator with the last report of a sample before the counters are reset.
+func endSample(r *report) {
+	windowsMu.Lock()
+	defer windowsMu.Unlock()
+	for _, w := range windows {
+		w.mu.Lock()
+		w.acc = w.acc.add(r.sub(w.last))
+		w.last = nil
+		w.mu.Unlock()
+	}
+}
+
+// next returns the report of the interval ending with the current report cur.
+func (w *window) next(cur *report) *report {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := w.acc.add(cur.sub(w.last))
+	r.sampleStart, r.time = w.start, cur.time
+	r.exitCount = cur.exitCount - w.exits
+	r.procs, r.parents, r.ancestry = cur.procs, cur.parents, cur.ancestry
+	w.last, w.acc, w.start, w.exits = cur, nil, cur.time, cur.exitCount
+	return r
+}
+
+// sub returns the per sample counters of r minus the ones of p, an older report of the same sample (nil for none).
+func (r *report) sub(p *report) *report {
+	d := *r
+	d.cmds = make([]cmdInfo, 0, len(r.cmds))
+	if p == nil {
+		d.cmds = append(d.cmds, r.cmds...)
+		return &d
+	}
+	prev := make(map[string]*cmdInfo, len(p.cmds))
+	for i := range p.cmds {
+		prev[p.cmds[i].cmd] = &p.cmds[i]
+	}
+	for _, ci := range r.cmds {
+		if pi := prev[ci.cmd]; pi != nil {
+			ci.subec -= pi.subec
+			ci.subet -= pi.subet
+			ci.ec -= pi.ec
+			ci.et -= pi.et
+			ci.slec -= pi.slec
+			ci.slet -= pi.slet
+			ci.rd -= pi.rd
+			ci.wr -= pi.wr
+			for i := range ci.xhist {
+				ci.xhist[i] -= pi.xhist[i]
+			}
+		}
+		d.cmds = append(d.cmds, ci)
+	}
+	for i := range d.ehist {
+		d.ehist[i] -= p.ehist[i]
+	}
+	d.busy -= p.busy
+	return &d
+}
+
+// add returns the sum of the per sample counters of a and r (a may be nil).
+func (a *report) add(r *report) *report {
+	if a == nil {
+		return r
+	}
+	s := *r
+	s.cmds = make([]cmdInfo, 0, len(a.cmds)+len(r.cmds))
+	idx := map[string]int{}
+	for _, l := range [][]cmdInfo{a.cmds, r.cmds} {
+		for _, ci := range l {
+			i, known := idx[ci.cmd]
+			if !known {
+				idx[ci.cmd] = len(s.cmds)
+				s.cmds = append(s.cmds, ci)
+				continue
+			}
+			c := &s.cmds[i]
+			c.subec += ci.subec
+			c.subet += ci.subet
+			c.ec += ci.ec
+			c.et += ci.et
+			c.slec += ci.slec
+			c.slet += ci.slet
+			c.uid = ci.uid
+			if ci.rss > c.rss {
+				c.rss = ci.rss
+			}
+			c.rd += ci.rd
+			c.wr += ci.wr
+			for i := range c.xhist {
+				c.xhist[i] += ci.xhist[i]
+			}
+		}
+	}
+	for i := range s.ehist {
+		s.ehist[i] += a.ehist[i]
+	}
+	s.busy += a.busy
+	return &s
+}
+
+// writerSink writes the reports to a file or stdout in one of the formats.
+type writerSink struct {
+	w      io.Writer
+	c      io.Closer // nil for stdout.
+	format string
+	n      uint // number of reports written.
+}
+
+// newSink creates the sink writing in format to dest.
+func newSink(format, dest string) (Sink, error) {
+	switch format {
+	case "statsd", "graphite":
+		return newPushSink(format, dest)
+	case "syslog", "journald":
+		return newLogSink(format, dest)
+	}
+	if strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://") {
+		return &httpSink{url: dest, format: format, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	s := &writerSink{format: format}
+	if dest == "" || dest == "-" {
+		s.w = os.Stdout
+		return s, nil
+	}
+	f, err := openLog(dest)
+	if err != nil {
+		return nil, err
+	}
+	s.w, s.c = f, f.f
+	return s, nil
+}
+
+func (s *writerSink) Write(r *report) error {
+	err := writeReport(s.w, s.format, s.n, r)
+	s.n++
+	return err
+}
+
+func (s *writerSink) Close() error {
+	if s.c != nil {
+		return s.c.Close()
+	}
+	return nil
+}
+
+// httpSink posts every report to a URL (eg: an InfluxDB write URL). The user info of the URL is sent as basic auth.
+type httpSink struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+// Content types of the formats.
+var contentTypes = map[string]string{"json": "application/json", "csv": "text/csv; charset=utf-8", "tsv": "text/tab-separated-values; charset=utf-8"}
+
+func (s *httpSink) Write(r *report) error {
+	var b bytes.Buffer
+	if err := writeReport(&b, s.format, 0, r); err != nil { // Every post is complete (csv header).
+		return err
+	}
+	ct, known := contentTypes[s.format]
+	if !known {
+		ct = "text/plain; charset=utf-8"
+	}
+	resp, err := s.client.Post(s.url, ct, &b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", s.url, strings.TrimSpace(resp.Status+" "+string(msg)))
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+// writeReport writes r to w in format. n is the number of reports already written to w. displayMu must not be held.
+func writeReport(w io.Writer, format string, n uint, r *report) error {
+	if format == "text" || format == "raw" {
+		printReportTo(w, format == "raw", n, r)
+		return nil
+	}
+	return encodeReport(w, format, n, r)
+}
+
+// encodeReport writes r to w in the json, csv, tsv or influx format.
+func encodeReport(w io.Writer, format string, n uint, r *report) error {
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(jsonReport(r))
+	case "influx":
+		return writeInflux(w, r)
+	}
+	return writeCSV(w, format == "tsv", n, r)
+}
+
+// startSinks creates the sinks and starts their tickers.
+func startSinks() error {
+	for _, sp := range sinkSpecs {
+		s, err := newSink(sp.format, sp.dest)
+		if err != nil {
+			return err
+		}
+		if as, ok := s.(alertSink); ok {
+			alertSinks = append(alertSinks, as)
+		}
+		w := &window{start: time.Now()}
+		windowsMu.Lock()
+		windows = append(windows, w)
+		windowsMu.Unlock()
+		go tickSink(s, w, sp.interval)
+	}
+	return nil
+}
+
+// tickSink writes a report to s every i.
+func tickSink(s Sink, w *window, i time.Duration) {
+	ticker := time.NewTicker(i)
+	for _ = range ticker.C {
+		r := peekReport()
+		if r.opts.clear {
+			r = w.next(r)
+		}
+		if err := s.Write(r); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: sink: %s\n", err)
+		}
+	}
+}
+
+// jsonCmd is a command in the json format.
+type jsonCmd struct {
+	Command    string  `json:"command"`
+	ET         uint64  `json:"et_us"`
+	EC         uint64  `json:"ec"`
+	CPUPercent float32 `json:"cpu_percent"`
+	ExecRate   float64 `json:"exec_rate"`
+	SubET      uint64  `json:"subet_us"`
+	SubEC      uint64  `json:"subec"`
+	SLET       uint64  `json:"short_lived_et_us"`
+	SLEC       uint64  `json:"short_lived_ec"`
+	AvgET      uint64  `json:"avg_et_us"`
+	P50        uint64  `json:"p50_et_us"`
+	P90        uint64  `json:"p90_et_us"`
+	P99        uint64  `json:"p99_et_us"`
+	UID        int     `json:"uid"`
+	RSS        *uint64 `json:"rss_kb,omitempty"` // nil if this kernel does not provide it.
+	ReadBytes  *uint64 `json:"read_bytes,omitempty"`
+	WriteBytes *uint64 `json:"write_bytes,omitempty"`
+}
+
+// jsonProc is a process of the tree or parents lists in the json format.
+type jsonProc struct {
+	PID     int    `json:"pid"`
+	PPID    int    `json:"ppid"`
+	Cmd     string `json:"command"`
+	ET      uint64 `json:"et_us"`
+	EC      uint64 `json:"ec"`
+	SubET   uint64 `json:"subet_us"`
+	SubEC   uint64 `json:"subec"`
+	ChildET uint64 `json:"children_et_us"`
+	ChildEC uint64 `json:"children_ec"`
+}
+
+// jsonStats is a report in the json format (one object per line).
+type jsonStats struct {
+	Host         string     `json:"host"`
+	Time         time.Time  `json:"time"`
+	Duration     float64    `json:"duration_s"`
+	CPUs         uint       `json:"cpus"`
+	ExitCount    uint64     `json:"exit_count"`
+	ExitRate     float64    `json:"exit_rate"`
+	PIDReuses    uint64     `json:"pid_reuses"`
+	BusyUS       uint64     `json:"busy_us"`
+	AccountedUS  uint64     `json:"accounted_us"`
+	ShortLivedUS uint64     `json:"short_lived_us"`
+	Histogram    []uint64   `json:"histogram,omitempty"`
+	Commands     []jsonCmd  `json:"commands"`
+	Tree         []jsonProc `json:"tree,omitempty"`
+	Parents      []jsonProc `json:"parents,omitempty"`
+}
+
+// newJSONCmd converts ci in a report of dts seconds to the json format.
+func newJSONCmd(ci *cmdInfo, dts float64) jsonCmd {
+	var avg uint64
+	if ci.ec != 0 {
+		avg = ci.et / ci.ec
+	}
+	return jsonCmd{ci.cmd, ci.et, ci.ec, cpuPercent(float64(ci.et), dts*1e6), float64(ci.ec) / dts, ci.subet, ci.subec, ci.slet, ci.slec,
+		avg, ci.percentile(50), ci.percentile(90), ci.percentile(99), ci.uid,
+		jsonFeature(taskstats.Extended, ci.rss), jsonFeature(taskstats.IO, ci.rd), jsonFeature(taskstats.IO, ci.wr)}
+}
+
+// jsonFeature returns v as a json value, nil (omitted) if this kernel does not provide the taskstats feature f.
+func jsonFeature(f taskstats.Feature, v uint64) *uint64 {
+	if probe != nil && !probe.Has(f) {
+		return nil
+	}
+	return &v
+}
+
+// jsonReport converts r to the json format. All the commands are there, sorted by the sort criteria.
+func jsonReport(r *report) *jsonStats {
+	dts := r.time.Sub(r.sampleStart).Seconds()
+	j := &jsonStats{Time: r.time, Duration: dts, CPUs: cpuNb, ExitCount: r.exitCount, ExitRate: float64(r.exitCount) / dts, PIDReuses: r.reusedCount, BusyUS: r.busy}
+	j.Host, _ = os.Hostname()
+	j.AccountedUS, j.ShortLivedUS = lifetimeShares(r)
+	if r.opts.hist {
+		j.Histogram = r.ehist[:]
+	}
+	for _, ci := range sortedCmds(r) {
+		j.Commands = append(j.Commands, newJSONCmd(ci, dts))
+	}
+	for _, l := range []struct {
+		nodes []procNode
+		dst   *[]jsonProc
+	}{{r.procs, &j.Tree}, {r.parents, &j.Parents}} {
+		for _, n := range l.nodes {
+			*l.dst = append(*l.dst, jsonProc{n.pid, n.ppid, n.cmd, n.et, n.ec, n.subet, n.subec, n.cet, n.cec})
+		}
+	}
+	return j
+}
+
+// sortedCmds returns the commands of r that pass the filters sorted by the sort criteria.
+func sortedCmds(r *report) []*cmdInfo {
+	filtersMu.RLock()
+	sc := sortCriteria
+	filtersMu.RUnlock()
+	return sortedCmdsBy(r, cmdKey(sc, false))
+}
+
+// sortedCmdsBy returns the commands of r that pass the filters sorted by decreasing key.
+func sortedCmdsBy(r *report, key func(ci *cmdInfo) uint64) []*cmdInfo {
+	var cs []*cmdInfo
+	filtersMu.RLock()
+	for j := range r.cmds {
+		if passes(r.cmds[j].cmd) {
+			cs = append(cs, &r.cmds[j])
+		}
+	}
+	filtersMu.RUnlock()
+	sort.SliceStable(cs, func(a, b int) bool { return key(cs[a]) > key(cs[b]) })
+	return cs
+}
+
+// cmdKey returns the sort key of sort criteria sc, for the command or its subprocesses (sub).
+func cmdKey(sc int, sub bool) func(ci *cmdInfo) uint64 {
+	switch {
+	case sc == scCount && sub:
+		return func(ci *cmdInfo) uint64 { return ci.subec }
+	case sc == scCount:
+		return func(ci *cmdInfo) uint64 { return ci.ec }
+	case sub:
+		return func(ci *cmdInfo) uint64 { return ci.subet }
+	}
+	return func(ci *cmdInfo) uint64 { return ci.et }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// counts returns the et and ec of every command of r.
+func counts(r *report) map[string][2]uint64 {
+	m := map[string][2]uint64{}
+	for _, ci := range r.cmds {
+		m[ci.cmd] = [2]uint64{ci.et, ci.ec}
+	}
+	return m
+}
+
+func TestReportSubAdd(t *testing.T) {
+	p := &report{busy: 100, cmds: []cmdInfo{{cmd: "a", et: 10, ec: 1, rd: 5}}}
+	p.ehist[1] = 1
+	r := &report{busy: 250, cmds: []cmdInfo{{cmd: "a", et: 30, ec: 3, rd: 8}, {cmd: "b", et: 7, ec: 1}}}
+	r.ehist[1] = 3
+	d := r.sub(p)
+	if got := counts(d); got["a"] != [2]uint64{20, 2} || got["b"] != [2]uint64{7, 1} || d.cmds[0].rd != 3 {
+		t.Errorf("sub: %v rd %d", got, d.cmds[0].rd)
+	}
+	if d.busy != 150 || d.ehist[1] != 2 {
+		t.Errorf("sub: busy %d ehist %d, want 150 2", d.busy, d.ehist[1])
+	}
+	if r.cmds[0].et != 30 {
+		t.Errorf("sub changed its receiver")
+	}
+	s := d.add(p)
+	if got := counts(s); got["a"] != [2]uint64{30, 3} || got["b"] != [2]uint64{7, 1} || s.busy != 250 || s.ehist[1] != 3 {
+		t.Errorf("add: %v busy %d ehist %d, want r back", got, s.busy, s.ehist[1])
+	}
+	if (*report)(nil).add(d) != d {
+		t.Errorf("add to nil must return its argument")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	saved := windows
+	defer func() { windows = saved }()
+	t0 := time.Now()
+	w := &window{start: t0}
+	windows = []*window{w}
+	rep := func(s int, exits uint64, cmds ...cmdInfo) *report {
+		return &report{sampleStart: t0, time: t0.Add(time.Duration(s) * time.Second), exitCount: exits, cmds: cmds}
+	}
+	tests := []struct {
+		name   string
+		cur    *report
+		end    bool // the report ends its sample (the main display resets the counters).
+		counts map[string][2]uint64
+		exits  uint64
+	}{
+		{"first", rep(1, 1, cmdInfo{cmd: "a", et: 100, ec: 1}), false, map[string][2]uint64{"a": {100, 1}}, 1},
+		{"same sample", rep(2, 4, cmdInfo{cmd: "a", et: 250, ec: 3}, cmdInfo{cmd: "b", et: 50, ec: 1}), false,
+			map[string][2]uint64{"a": {150, 2}, "b": {50, 1}}, 3},
+		{"sample end", rep(3, 5, cmdInfo{cmd: "a", et: 300, ec: 4}, cmdInfo{cmd: "b", et: 50, ec: 1}), true, nil, 0},
+		{"next sample", rep(4, 6, cmdInfo{cmd: "a", et: 10, ec: 1}), false, map[string][2]uint64{"a": {60, 2}, "b": {0, 0}}, 2},
+	}
+	for _, tt := range tests {
+		if tt.end {
+			endSample(tt.cur)
+			continue
+		}
+		r := w.next(tt.cur)
+		if got := counts(r); len(got) != len(tt.counts) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.counts)
+		} else {
+			for c, v := range tt.counts {
+				if got[c] != v {
+					t.Errorf("%s: %v, want %v", tt.name, got, tt.counts)
+				}
+			}
+		}
+		if r.exitCount != tt.exits || !r.time.Equal(tt.cur.time) {
+			t.Errorf("%s: exits %d time %s, want %d %s", tt.name, r.exitCount, r.time, tt.exits, tt.cur.time)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+/* Exit events streaming (-e).
+* One record per process exit, as it happens, on the output: time, pid, ppid, uid, command, cpu, lifetime, exit status and
+* ancestry, as text or JSON (one object per line). Only the commands matching the filters (-f) are written.
+* The periodic reports still run (alerts, -c, -n) but are not written to the output.
+* The aggregator must never wait for the output (a display holds displayMu while it waits for a report) so the records go
+* through a buffered channel to a writer goroutine and are dropped when it is full.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var eventFmt string // -e value: text or json ("" for no streaming).
+
+var streamCh = make(chan *exitRecord, 4096)
+var streamDrops uint64 // records dropped because the writer was too slow.
+
+// exitRecord is a streamed process exit.
+type exitRecord struct {
+	Time     time.Time `json:"time"`
+	PID      int       `json:"pid"`
+	PPID     int       `json:"ppid"`
+	UID      int       `json:"uid"`
+	Comm     string    `json:"comm"`
+	CPU      uint64    `json:"cpu_us"`
+	Lifetime uint64    `json:"lifetime_us"`
+	ExitCode int       `json:"exit_code"`
+	Signal   int       `json:"signal,omitempty"` // the signal that killed the process.
+	Ancestry []string  `json:"ancestry"`         // "cmd[pid]", parent first.
+}
+
+// streamExit queues the record of exit ev. pi is what we knew of the process before its exit (nil if nothing).
+// Runs in the aggregator.
+func streamExit(ev *exitEvent, pi *procInfo) {
+	if !shown(ev.cmd) {
+		return
+	}
+	x := &exitRecord{Time: time.Now(), PID: ev.pid, PPID: ev.ppid, UID: ev.uid, Comm: ev.cmd, CPU: ev.cpu, Lifetime: ev.life}
+	// The exit code is a wait status.
+	if sig := int(ev.code & 0x7f); sig != 0 {
+		x.Signal = sig
+	} else {
+		x.ExitCode = int(ev.code>>8) & 0xff
+	}
+	parent := procInfos[ev.ppid]
+	if pi != nil && pi.ppi != nil && sameStart(pi.start, ev.start) {
+		parent = pi.ppi // The original parent (-A original) or the one we saw last.
+		x.PPID = parent.pid
+	}
+	x.Ancestry = ancestryOf(parent)
+	select {
+	case streamCh <- x:
+	default:
+		atomic.AddUint64(&streamDrops, 1)
+	}
+}
+
+// writeStream writes the queued records to the output.
+func writeStream() {
+	var drops uint64
+	for x := range streamCh {
+		if d := atomic.LoadUint64(&streamDrops); d != drops {
+			fmt.Fprintf(os.Stderr, "Warning: %d exit records dropped (the output is too slow)\n", d-drops)
+			drops = d
+		}
+		displayMu.Lock()
+		if eventFmt == "json" {
+			json.NewEncoder(out).Encode(x)
+		} else {
+			status := fmt.Sprintf("exit %d", x.ExitCode)
+			if x.Signal != 0 {
+				status = fmt.Sprintf("signal %d", x.Signal)
+			}
+			fmt.Fprintf(out, "%s %s[%d] ppid %d uid %d cpu %s life %s %s ancestry %s\n", x.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+				x.Comm, x.PID, x.PPID, x.UID, time.Duration(x.CPU*1e3), time.Duration(x.Lifetime*1e3), status, strings.Join(x.Ancestry, " "))
+		}
+		displayMu.Unlock()
+	}
+}
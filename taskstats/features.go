@@ -0,0 +1,105 @@
+package taskstats
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// Feature is a group of taskstats fields added to the struct by a given version.
+type Feature int
+
+const (
+	Delay       Feature = iota // cpu, blkio and swapin delays.
+	Basic                      // command, uid, pid, ppid, begin time, cpu times, page faults.
+	Extended                   // memory usage, read/write chars and syscalls.
+	IO                         // storage read/write bytes.
+	CtxSwitch                  // voluntary/involuntary context switches.
+	Scaled                     // SMT scaled cpu times.
+	Freepages                  // memory reclaim delay.
+	Thrashing                  // thrashing page delay.
+	BTime64                    // 64-bit begin time.
+	Compact                    // memory compaction delay.
+	ThreadGroup                // tgid, thread group elapsed time, executable dev/inode.
+	Wpcopy                     // write-protect copy delay.
+	IRQ                        // irq/softirq delay.
+	featureNb
+)
+
+// First struct version providing a feature and the struct size needed to hold its fields.
+var features = [featureNb]struct {
+	name    string
+	version uint16
+	end     int
+}{
+	Delay:       {"delay", 1, offComm},
+	Basic:       {"basic", 2, offCoremem},
+	Extended:    {"extended", 3, offReadBytes},
+	IO:          {"io", 4, offNvcsw},
+	CtxSwitch:   {"ctxswitch", 5, offUTimeScaled},
+	Scaled:      {"scaled", 6, offFreepagesCount},
+	Freepages:   {"freepages", 7, offThrashingCount},
+	Thrashing:   {"thrashing", 9, offBTime64},
+	BTime64:     {"btime64", 10, offCompactCount},
+	Compact:     {"compact", 11, offTGID},
+	ThreadGroup: {"threadgroup", 12, offWpcopyCount},
+	Wpcopy:      {"wpcopy", 13, offIRQCount},
+	IRQ:         {"irq", 14, offIRQDelayTotal + 8},
+}
+
+// Features returns all known features.
+func Features() []Feature {
+	fs := make([]Feature, featureNb)
+	for i := range fs {
+		fs[i] = Feature(i)
+	}
+	return fs
+}
+
+func (f Feature) String() string {
+	if f < 0 || f >= featureNb {
+		return "unknown"
+	}
+	return features[f].name
+}
+
+// isDelay tells if the feature fields are delays (only filled when delay accounting is enabled).
+func (f Feature) isDelay() bool {
+	switch f {
+	case Delay, Freepages, Thrashing, Compact, Wpcopy, IRQ:
+		return true
+	}
+	return false
+}
+
+// Has tells if the kernel that sent these stats provides the feature fields.
+// Fields of a missing feature are zero and must be shown as unavailable, not as zero.
+func (s *Stats) Has(f Feature) bool {
+	if f < 0 || f >= featureNb {
+		return false
+	}
+	if s.Version < features[f].version || s.Size < features[f].end {
+		return false
+	}
+	if f.isDelay() && !delayAcct {
+		return false
+	}
+	return true
+}
+
+// StartTime returns the task begin time [sec since 1970] using the 64-bit field when available.
+func (s *Stats) StartTime() uint64 {
+	if s.Has(BTime64) {
+		return s.BTime64
+	}
+	return uint64(s.BTime)
+}
+
+// delayAcct is false when delay accounting is disabled (kernel.task_delayacct sysctl, off by default since Linux 5.14).
+var delayAcct = true
+
+func init() {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/task_delayacct")
+	if err == nil && strings.TrimSpace(string(b)) == "0" {
+		delayAcct = false
+	}
+}
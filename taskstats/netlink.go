@@ -0,0 +1,243 @@
+package taskstats
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Generic netlink and taskstats constants (linux/genetlink.h, linux/taskstats.h).
+const (
+	genlIDCtrl          = 0x10 // GENL_ID_CTRL
+	ctrlCmdGetFamily    = 3    // CTRL_CMD_GETFAMILY
+	ctrlAttrFamilyID    = 1    // CTRL_ATTR_FAMILY_ID
+	ctrlAttrFamilyName  = 2    // CTRL_ATTR_FAMILY_NAME
+	familyName          = "TASKSTATS"
+	cmdGet              = 1 // TASKSTATS_CMD_GET
+	cmdAttrPID          = 1 // TASKSTATS_CMD_ATTR_PID
+	cmdAttrTGID         = 2 // TASKSTATS_CMD_ATTR_TGID
+	cmdAttrRegisterCPUs = 3 // TASKSTATS_CMD_ATTR_REGISTER_CPUMASK
+	cmdAttrDeregister   = 4 // TASKSTATS_CMD_ATTR_DEREGISTER_CPUMASK
+	typePID             = 1 // TASKSTATS_TYPE_PID
+	typeTGID            = 2 // TASKSTATS_TYPE_TGID
+	typeStats           = 3 // TASKSTATS_TYPE_STATS
+	typeAggrPID         = 4 // TASKSTATS_TYPE_AGGR_PID
+	typeAggrTGID        = 5 // TASKSTATS_TYPE_AGGR_TGID
+
+	nlmsgHdrLen = 16
+	genlHdrLen  = 4
+	nlaHdrLen   = 4
+	nlaTypeMask = 0x3fff // strip NLA_F_NESTED and NLA_F_NET_BYTEORDER
+
+	// Maximum size of a received datagram. A stats reply is about 500 bytes.
+	maxMsgSize = 8192
+)
+
+// ErrOverrun is returned by Receive when the socket receive buffer overflowed: the kernel dropped some messages.
+var ErrOverrun = errors.New("taskstats: netlink receive buffer overrun, messages lost")
+
+// Error is a NLMSG_ERROR reply from the kernel.
+type Error struct {
+	Errno syscall.Errno
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("taskstats: netlink error %d: %s", int(e.Errno), e.Errno.Error())
+}
+
+// Conn is a generic netlink socket bound to the TASKSTATS family.
+// A Conn is not safe for concurrent use, use one Conn per goroutine.
+type Conn struct {
+	socket
+	family uint16
+}
+
+// Dial opens a generic netlink socket and resolves the TASKSTATS family id.
+// Using taskstats requires root privileges (CAP_NET_ADMIN for the exit stats).
+func Dial() (*Conn, error) {
+	s, err := openSocket("taskstats", syscall.SOCK_RAW, syscall.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{socket: s}
+	if err = c.resolveFamily(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the socket.
+func (c *Conn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// Register asks for the exit stats of all tasks dying on the cpus in mask (eg: "0-7" or "0,2,4").
+// The stats are then read with Receive.
+func (c *Conn) Register(mask string) error {
+	return c.send(c.family, cmdGet, cmdAttrRegisterCPUs, append([]byte(mask), 0))
+}
+
+// Deregister stops the exit stats for the cpus in mask.
+func (c *Conn) Deregister(mask string) error {
+	return c.send(c.family, cmdGet, cmdAttrDeregister, append([]byte(mask), 0))
+}
+
+// PID returns the current stats of the task pid.
+func (c *Conn) PID(pid int) (*Stats, error) {
+	return c.get(cmdAttrPID, pid)
+}
+
+// TGID returns the current stats of the thread group tgid (sum over all its threads).
+func (c *Conn) TGID(tgid int) (*Stats, error) {
+	return c.get(cmdAttrTGID, tgid)
+}
+
+func (c *Conn) get(attr uint16, id int) (*Stats, error) {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, uint32(id))
+	if err := c.send(c.family, cmdGet, attr, b); err != nil {
+		return nil, err
+	}
+	sts, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(sts) == 0 {
+		return nil, fmt.Errorf("taskstats: no stats for %d", id)
+	}
+	return sts[0], nil
+}
+
+// Receive reads one datagram and returns all the stats it holds.
+// Syscall errors are returned as syscall.Errno, NLMSG_ERROR replies as *Error and a receive buffer overflow as ErrOverrun.
+func (c *Conn) Receive() ([]*Stats, error) {
+	b, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessages(b)
+}
+
+// send sends a generic netlink request with a single attribute.
+func (c *Conn) send(family uint16, cmd uint8, attr uint16, data []byte) error {
+	alen := nlaHdrLen + len(data)
+	l := nlmsgHdrLen + genlHdrLen + align(alen)
+	b := make([]byte, l)
+	nativeEndian.PutUint32(b[0:], uint32(l))
+	nativeEndian.PutUint16(b[4:], family)
+	nativeEndian.PutUint16(b[6:], syscall.NLM_F_REQUEST)
+	nativeEndian.PutUint32(b[8:], 0) // seq
+	nativeEndian.PutUint32(b[12:], c.portid)
+	b[16] = cmd
+	b[17] = 1 // genl version
+	a := b[nlmsgHdrLen+genlHdrLen:]
+	nativeEndian.PutUint16(a[0:], uint16(alen))
+	nativeEndian.PutUint16(a[2:], attr)
+	copy(a[nlaHdrLen:], data)
+	return c.sendto(b)
+}
+
+// resolveFamily asks the generic netlink controller for the TASKSTATS family id.
+func (c *Conn) resolveFamily() error {
+	if err := c.send(genlIDCtrl, ctrlCmdGetFamily, ctrlAttrFamilyName, append([]byte(familyName), 0)); err != nil {
+		return err
+	}
+	b, err := c.recv()
+	if err != nil {
+		return fmt.Errorf("taskstats: error getting family id: %s", err)
+	}
+	var id uint16
+	err = walkMessages(b, func(payload []byte) error {
+		return walkAttrs(payload, func(typ uint16, data []byte) error {
+			if typ == ctrlAttrFamilyID && len(data) >= 2 {
+				id = nativeEndian.Uint16(data)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("taskstats: error getting family id: %s", err)
+	}
+	if id == 0 {
+		return fmt.Errorf("taskstats: family %s not found (kernel without CONFIG_TASKSTATS?)", familyName)
+	}
+	c.family = id
+	return nil
+}
+
+// ParseMessages parses a datagram received on a taskstats socket and returns all the stats it holds.
+// Both per task (TASKSTATS_TYPE_AGGR_PID) and per thread group (TASKSTATS_TYPE_AGGR_TGID) stats are returned.
+func ParseMessages(b []byte) ([]*Stats, error) {
+	var sts []*Stats
+	err := walkMessages(b, func(payload []byte) error {
+		return walkAttrs(payload, func(typ uint16, data []byte) error {
+			switch typ {
+			case typeAggrPID, typeAggrTGID:
+				// Nested: the pid/tgid then the stats.
+				return walkAttrs(data, func(typ uint16, data []byte) error {
+					if typ != typeStats {
+						return nil
+					}
+					st, err := ParseStats(data)
+					if err != nil {
+						return err
+					}
+					sts = append(sts, st)
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	return sts, err
+}
+
+// walkMessages calls f with the generic netlink payload (after the genl header) of every message in b.
+func walkMessages(b []byte, f func(payload []byte) error) error {
+	for len(b) >= nlmsgHdrLen {
+		l := int(nativeEndian.Uint32(b[0:]))
+		typ := nativeEndian.Uint16(b[4:])
+		if l < nlmsgHdrLen || l > len(b) {
+			return fmt.Errorf("taskstats: bad message length %d", l)
+		}
+		m := b[nlmsgHdrLen:l]
+		switch {
+		case typ == syscall.NLMSG_ERROR:
+			if len(m) < 4 {
+				return fmt.Errorf("taskstats: short error message")
+			}
+			if e := int32(nativeEndian.Uint32(m)); e != 0 {
+				return &Error{Errno: syscall.Errno(-e)}
+			}
+		case typ == syscall.NLMSG_DONE || typ == syscall.NLMSG_NOOP:
+		case len(m) >= genlHdrLen:
+			if err := f(m[genlHdrLen:]); err != nil {
+				return err
+			}
+		}
+		b = b[min(align(l), len(b)):]
+	}
+	return nil
+}
+
+// walkAttrs calls f for every netlink attribute in b.
+func walkAttrs(b []byte, f func(typ uint16, data []byte) error) error {
+	for len(b) >= nlaHdrLen {
+		l := int(nativeEndian.Uint16(b[0:]))
+		typ := nativeEndian.Uint16(b[2:]) & nlaTypeMask
+		if l < nlaHdrLen || l > len(b) {
+			return fmt.Errorf("taskstats: bad attribute length %d", l)
+		}
+		if err := f(typ, b[nlaHdrLen:l]); err != nil {
+			return err
+		}
+		b = b[min(align(l), len(b)):]
+	}
+	return nil
+}
+
+// align rounds l up to the netlink 4 bytes alignment.
+func align(l int) int {
+	return (l + 3) &^ 3
+}
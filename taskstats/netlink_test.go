@@ -0,0 +1,106 @@
+package taskstats
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// The fixtures in testdata were captured on a little endian x86_64 host (taskstats version 16):
+// pid_reply.hex: the reply to a TASKSTATS_CMD_GET for a pid, exit.hex: the exit stats of /bin/true,
+// esrch.hex: the NLMSG_ERROR reply for a pid that does not exist, fork.hex: a PROC_EVENT_FORK notification.
+
+// fixture returns the bytes of testdata/name.hex.
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	if nativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the fixtures were captured on a little endian host")
+	}
+	s, err := os.ReadFile("testdata/" + name + ".hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hex.DecodeString(strings.Join(strings.Fields(string(s)), ""))
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return b
+}
+
+// Offset of the struct taskstats in the captured stats messages:
+// nlmsghdr, genlmsghdr, TASKSTATS_TYPE_AGGR_PID, TASKSTATS_TYPE_PID (u32) then TASKSTATS_TYPE_STATS.
+const fixtureStatsOff = nlmsgHdrLen + genlHdrLen + nlaHdrLen + nlaHdrLen + 4 + nlaHdrLen
+
+// statsMessage returns a message holding st as the stats of pid.
+func statsMessage(pid uint32, st []byte) []byte {
+	attr := func(typ uint16, data []byte) []byte {
+		a := make([]byte, align(nlaHdrLen+len(data)))
+		nativeEndian.PutUint16(a[0:], uint16(nlaHdrLen+len(data)))
+		nativeEndian.PutUint16(a[2:], typ)
+		copy(a[nlaHdrLen:], data)
+		return a
+	}
+	p := make([]byte, 4)
+	nativeEndian.PutUint32(p, pid)
+	b := make([]byte, nlmsgHdrLen+genlHdrLen)
+	b = append(b, attr(typeAggrPID, append(attr(typePID, p), attr(typeStats, st)...))...)
+	nativeEndian.PutUint32(b[0:], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:], 0x1f) // The TASKSTATS family id of the capture host.
+	return b
+}
+
+func TestParseMessages(t *testing.T) {
+	reply := fixture(t, "pid_reply")
+	exit := fixture(t, "exit")
+	cut := append([]byte{}, reply[:300]...)
+	nativeEndian.PutUint32(cut[0:], 300) // A consistent message length but the attributes go beyond it.
+	tests := []struct {
+		name  string
+		b     []byte
+		pids  []uint32
+		comms []string
+		err   string // expected error substring ("" for none).
+	}{
+		{"stats reply", reply, []uint32{26370}, []string{"taskstats.test"}, ""},
+		{"exit stats", exit, []uint32{26482}, []string{"true"}, ""},
+		{"two messages", append(append([]byte{}, reply...), exit...), []uint32{26370, 26482}, []string{"taskstats.test", "true"}, ""},
+		{"empty", nil, nil, nil, ""},
+		{"short stats", statsMessage(42, reply[fixtureStatsOff:fixtureStatsOff+40]), nil, nil, "stats too short"},
+		{"truncated datagram", reply[:100], nil, nil, "bad message length"},
+		{"truncated attribute", cut, nil, nil, "bad attribute length"},
+		{"nlmsg error", fixture(t, "esrch"), nil, nil, "no such process"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts, err := ParseMessages(tt.b)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sts) != len(tt.pids) {
+				t.Fatalf("%d stats, want %d", len(sts), len(tt.pids))
+			}
+			for i, st := range sts {
+				if st.PID != tt.pids[i] || st.Comm != tt.comms[i] {
+					t.Errorf("stats %d: pid %d comm %q, want %d %q", i, st.PID, st.Comm, tt.pids[i], tt.comms[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseMessagesError(t *testing.T) {
+	_, err := ParseMessages(fixture(t, "esrch"))
+	var e *Error
+	if !errors.As(err, &e) || e.Errno != syscall.ESRCH {
+		t.Fatalf("error %v, want an *Error with ESRCH", err)
+	}
+}
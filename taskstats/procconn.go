@@ -0,0 +1,107 @@
+package taskstats
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Process events connector constants (linux/connector.h, linux/cn_proc.h).
+const (
+	netlinkConnector  = 11 // NETLINK_CONNECTOR
+	cnIdxProc         = 1  // CN_IDX_PROC
+	cnValProc         = 1  // CN_VAL_PROC
+	procCnMcastListen = 1  // PROC_CN_MCAST_LISTEN
+	procCnMcastIgnore = 2  // PROC_CN_MCAST_IGNORE
+	procEventFork     = 1  // PROC_EVENT_FORK
+
+	cnMsgLen = 20 // struct cn_msg header
+)
+
+// ForkEvent is a PROC_EVENT_FORK notification.
+type ForkEvent struct {
+	ParentPID  uint32
+	ParentTGID uint32
+	ChildPID   uint32
+	ChildTGID  uint32
+	Timestamp  uint64 // [ns since boot, CLOCK_MONOTONIC: the suspends are not counted]
+}
+
+// ProcConn is a netlink connector socket receiving the process events (CONFIG_PROC_EVENTS).
+// Unlike the taskstats exit stats, fork events tell who the parent was before any reparenting.
+type ProcConn struct {
+	socket
+}
+
+// DialProc opens a connector socket and subscribes to the process events. It requires root privileges.
+func DialProc() (*ProcConn, error) {
+	s, err := openSocket("proc connector", syscall.SOCK_DGRAM, netlinkConnector, cnIdxProc)
+	if err != nil {
+		return nil, err
+	}
+	c := &ProcConn{s}
+	if err = c.mcast(procCnMcastListen); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close unsubscribes and closes the socket.
+func (c *ProcConn) Close() error {
+	c.mcast(procCnMcastIgnore)
+	return syscall.Close(c.fd)
+}
+
+// Receive reads one datagram and returns the fork events it holds (other process events are skipped).
+// A receive buffer overflow is returned as ErrOverrun.
+func (c *ProcConn) Receive() ([]ForkEvent, error) {
+	b, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	return ParseProcEvents(b)
+}
+
+// mcast sends a PROC_CN_MCAST_* operation.
+func (c *ProcConn) mcast(op uint32) error {
+	l := nlmsgHdrLen + cnMsgLen + 4
+	b := make([]byte, l)
+	nativeEndian.PutUint32(b[0:], uint32(l))
+	nativeEndian.PutUint16(b[4:], syscall.NLMSG_DONE)
+	nativeEndian.PutUint32(b[12:], c.portid)
+	m := b[nlmsgHdrLen:]
+	nativeEndian.PutUint32(m[0:], cnIdxProc)
+	nativeEndian.PutUint32(m[4:], cnValProc)
+	nativeEndian.PutUint16(m[16:], 4) // len
+	nativeEndian.PutUint32(m[cnMsgLen:], op)
+	return c.sendto(b)
+}
+
+// ParseProcEvents parses a datagram received on a process events connector socket and returns its fork events.
+func ParseProcEvents(b []byte) ([]ForkEvent, error) {
+	var evs []ForkEvent
+	for len(b) >= nlmsgHdrLen {
+		l := int(nativeEndian.Uint32(b[0:]))
+		if l < nlmsgHdrLen || l > len(b) {
+			return evs, fmt.Errorf("proc connector: bad message length %d", l)
+		}
+		m := b[nlmsgHdrLen:l]
+		b = b[min(align(l), len(b)):]
+		if len(m) < cnMsgLen || nativeEndian.Uint32(m[0:]) != cnIdxProc {
+			continue
+		}
+		// struct proc_event: what, cpu, timestamp_ns then the event data.
+		pe := m[cnMsgLen:]
+		if len(pe) < 32 || nativeEndian.Uint32(pe[0:]) != procEventFork {
+			continue
+		}
+		evs = append(evs, ForkEvent{
+			Timestamp:  nativeEndian.Uint64(pe[8:]),
+			ParentPID:  nativeEndian.Uint32(pe[16:]),
+			ParentTGID: nativeEndian.Uint32(pe[20:]),
+			ChildPID:   nativeEndian.Uint32(pe[24:]),
+			ChildTGID:  nativeEndian.Uint32(pe[28:]),
+		})
+	}
+	return evs, nil
+}
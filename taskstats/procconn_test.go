@@ -0,0 +1,50 @@
+package taskstats
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProcEvents(t *testing.T) {
+	fork := fixture(t, "fork")
+	want := ForkEvent{ParentPID: 26284, ParentTGID: 26280, ChildPID: 26376, ChildTGID: 26370, Timestamp: 3505723411602}
+	other := append([]byte{}, fork...)
+	nativeEndian.PutUint32(other[nlmsgHdrLen+cnMsgLen:], 0) // PROC_EVENT_NONE (the subscription ack).
+	notProc := append([]byte{}, fork...)
+	nativeEndian.PutUint32(notProc[nlmsgHdrLen:], cnIdxProc+1)
+	tests := []struct {
+		name string
+		b    []byte
+		n    int    // expected number of fork events.
+		err  string // expected error substring ("" for none).
+	}{
+		{"fork", fork, 1, ""},
+		{"two messages", append(append([]byte{}, fork...), fork...), 2, ""},
+		{"other event", other, 0, ""},
+		{"other connector", notProc, 0, ""},
+		{"short event", fork[:nlmsgHdrLen+cnMsgLen+16], 0, "bad message length"},
+		{"empty", nil, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evs, err := ParseProcEvents(tt.b)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(evs) != tt.n {
+				t.Fatalf("%d events, want %d", len(evs), tt.n)
+			}
+			for _, ev := range evs {
+				if ev != want {
+					t.Errorf("event %+v, want %+v", ev, want)
+				}
+			}
+		})
+	}
+}
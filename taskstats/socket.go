@@ -0,0 +1,87 @@
+package taskstats
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// socket is the netlink socket embedded in Conn and ProcConn.
+type socket struct {
+	fd     int
+	portid uint32
+	buf    []byte
+	name   string // prefix of the error messages.
+}
+
+// openSocket opens a netlink socket of protocol proto (type typ) and binds it to the multicast groups.
+func openSocket(name string, typ, proto int, groups uint32) (socket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, typ|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return socket{}, fmt.Errorf("%s: socket: %s", name, err)
+	}
+	s := socket{fd: fd, buf: make([]byte, maxMsgSize), name: name}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return socket{}, fmt.Errorf("%s: bind: %s", name, err)
+	}
+	if sa, err := syscall.Getsockname(fd); err == nil {
+		if nl, ok := sa.(*syscall.SockaddrNetlink); ok {
+			s.portid = nl.Pid
+		}
+	}
+	return s, nil
+}
+
+// SetReadBuffer sets the socket receive buffer size. As root it can go over net.core.rmem_max.
+// It only applies to messages received after the call.
+func (s *socket) SetReadBuffer(bytes int) error {
+	err := syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, bytes)
+	if err != nil {
+		err = syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: unable to set socket rcv buf size to %d: %s", s.name, bytes, err)
+	}
+	return nil
+}
+
+// Inode returns the socket inode. It identifies the socket in /proc/net/netlink.
+func (s *socket) Inode() uint64 {
+	var st syscall.Stat_t
+	if syscall.Fstat(s.fd, &st) != nil {
+		return 0
+	}
+	return st.Ino
+}
+
+// recv reads one datagram in s.buf (valid until the next call).
+// Syscall errors are returned as syscall.Errno and a receive buffer overflow as ErrOverrun.
+func (s *socket) recv() ([]byte, error) {
+	for {
+		n, _, err := syscall.Recvfrom(s.fd, s.buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			return nil, ErrOverrun
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.buf[:n], nil
+	}
+}
+
+// sendto sends b to the kernel.
+func (s *socket) sendto(b []byte) error {
+	for {
+		err := syscall.Sendto(s.fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: sendto: %s", s.name, err)
+		}
+		return nil
+	}
+}
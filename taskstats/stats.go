@@ -0,0 +1,264 @@
+// Package taskstats is a pure Go client of the Linux taskstats generic netlink interface.
+//
+// It resolves the TASKSTATS family, registers for the exit stats of a set of CPUs, requests the stats of a given pid
+// and parses the replies into typed structs.
+// It also reads the fork notifications of the process events connector (ProcConn).
+//
+// All the API is described in:
+// https://www.kernel.org/doc/Documentation/accounting/taskstats.txt
+// https://www.kernel.org/doc/Documentation/accounting/taskstats-struct.txt
+package taskstats
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// CommLen is the size of the command name field (TS_COMM_LEN).
+const CommLen = 32
+
+// Stats mirrors struct taskstats from linux/taskstats.h (up to version 14).
+// Times are in usec for the ac_* fields and in ns for the delay fields.
+// Fields beyond Size (the length of the struct the kernel sent) are left to zero.
+type Stats struct {
+	Size int // number of bytes of the struct sent by the kernel.
+
+	// version 1: delay accounting.
+	Version            uint16
+	ExitCode           uint32
+	Flag               uint8
+	Nice               uint8
+	CPUCount           uint64
+	CPUDelayTotal      uint64
+	BlkioCount         uint64
+	BlkioDelayTotal    uint64
+	SwapinCount        uint64
+	SwapinDelayTotal   uint64
+	CPURunRealTotal    uint64
+	CPURunVirtualTotal uint64
+
+	// Basic accounting.
+	Comm   string
+	Sched  uint8
+	UID    uint32
+	GID    uint32
+	PID    uint32
+	PPID   uint32
+	BTime  uint32 // begin time [sec since 1970]
+	ETime  uint64 // elapsed time [usec]
+	UTime  uint64 // user CPU time [usec]
+	STime  uint64 // system CPU time [usec]
+	MinFlt uint64
+	MajFlt uint64
+
+	// Extended accounting.
+	Coremem       uint64 // accumulated RSS usage in MB-usec
+	Virtmem       uint64 // accumulated VM usage in MB-usec
+	HiwaterRSS    uint64 // [KB]
+	HiwaterVM     uint64 // [KB]
+	ReadChar      uint64
+	WriteChar     uint64
+	ReadSyscalls  uint64
+	WriteSyscalls uint64
+
+	// Storage I/O accounting.
+	ReadBytes           uint64
+	WriteBytes          uint64
+	CancelledWriteBytes uint64
+	Nvcsw               uint64
+	Nivcsw              uint64
+
+	UTimeScaled           uint64
+	STimeScaled           uint64
+	CPUScaledRunRealTotal uint64
+
+	FreepagesCount      uint64
+	FreepagesDelayTotal uint64
+	ThrashingCount      uint64
+	ThrashingDelayTotal uint64
+	BTime64             uint64 // 64-bit begin time [sec since 1970]
+	CompactCount        uint64
+	CompactDelayTotal   uint64
+	TGID                uint32
+	TGETime             uint64
+	ExeDev              uint64
+	ExeInode            uint64
+	WpcopyCount         uint64
+	WpcopyDelayTotal    uint64
+	IRQCount            uint64
+	IRQDelayTotal       uint64
+}
+
+// Offsets of the struct taskstats fields (natural alignment plus the explicit aligned(8) of the C header).
+const (
+	offVersion               = 0
+	offExitCode              = 4
+	offFlag                  = 8
+	offNice                  = 9
+	offCPUCount              = 16
+	offCPUDelayTotal         = 24
+	offBlkioCount            = 32
+	offBlkioDelayTotal       = 40
+	offSwapinCount           = 48
+	offSwapinDelayTotal      = 56
+	offCPURunRealTotal       = 64
+	offCPURunVirtualTotal    = 72
+	offComm                  = 80
+	offSched                 = 112
+	offUID                   = 120
+	offGID                   = 124
+	offPID                   = 128
+	offPPID                  = 132
+	offBTime                 = 136
+	offETime                 = 144
+	offUTime                 = 152
+	offSTime                 = 160
+	offMinFlt                = 168
+	offMajFlt                = 176
+	offCoremem               = 184
+	offVirtmem               = 192
+	offHiwaterRSS            = 200
+	offHiwaterVM             = 208
+	offReadChar              = 216
+	offWriteChar             = 224
+	offReadSyscalls          = 232
+	offWriteSyscalls         = 240
+	offReadBytes             = 248
+	offWriteBytes            = 256
+	offCancelledWriteBytes   = 264
+	offNvcsw                 = 272
+	offNivcsw                = 280
+	offUTimeScaled           = 288
+	offSTimeScaled           = 296
+	offCPUScaledRunRealTotal = 304
+	offFreepagesCount        = 312
+	offFreepagesDelayTotal   = 320
+	offThrashingCount        = 328
+	offThrashingDelayTotal   = 336
+	offBTime64               = 344
+	offCompactCount          = 352
+	offCompactDelayTotal     = 360
+	offTGID                  = 368
+	offTGETime               = 376
+	offExeDev                = 384
+	offExeInode              = 392
+	offWpcopyCount           = 400
+	offWpcopyDelayTotal      = 408
+	offIRQCount              = 416
+	offIRQDelayTotal         = 424
+)
+
+// Netlink uses the host byte order.
+var nativeEndian = binary.NativeEndian
+
+// reader decodes the fields of a struct taskstats, fields out of the buffer read as 0.
+type reader []byte
+
+func (r reader) u8(off int) uint8 {
+	if off+1 > len(r) {
+		return 0
+	}
+	return r[off]
+}
+
+func (r reader) u16(off int) uint16 {
+	if off+2 > len(r) {
+		return 0
+	}
+	return nativeEndian.Uint16(r[off:])
+}
+
+func (r reader) u32(off int) uint32 {
+	if off+4 > len(r) {
+		return 0
+	}
+	return nativeEndian.Uint32(r[off:])
+}
+
+func (r reader) u64(off int) uint64 {
+	if off+8 > len(r) {
+		return 0
+	}
+	return nativeEndian.Uint64(r[off:])
+}
+
+// cstring returns the NUL terminated string at off (at most n bytes).
+func (r reader) cstring(off, n int) string {
+	if off >= len(r) {
+		return ""
+	}
+	b := r[off:min(off+n, len(r))]
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// ParseStats decodes the payload of a TASKSTATS_TYPE_STATS attribute.
+// Older kernels send a shorter struct, missing fields are left to zero.
+func ParseStats(b []byte) (*Stats, error) {
+	if len(b) < offComm {
+		return nil, fmt.Errorf("taskstats: stats too short (%d bytes)", len(b))
+	}
+	r := reader(b)
+	return &Stats{
+		Size:                  len(b),
+		Version:               r.u16(offVersion),
+		ExitCode:              r.u32(offExitCode),
+		Flag:                  r.u8(offFlag),
+		Nice:                  r.u8(offNice),
+		CPUCount:              r.u64(offCPUCount),
+		CPUDelayTotal:         r.u64(offCPUDelayTotal),
+		BlkioCount:            r.u64(offBlkioCount),
+		BlkioDelayTotal:       r.u64(offBlkioDelayTotal),
+		SwapinCount:           r.u64(offSwapinCount),
+		SwapinDelayTotal:      r.u64(offSwapinDelayTotal),
+		CPURunRealTotal:       r.u64(offCPURunRealTotal),
+		CPURunVirtualTotal:    r.u64(offCPURunVirtualTotal),
+		Comm:                  r.cstring(offComm, CommLen),
+		Sched:                 r.u8(offSched),
+		UID:                   r.u32(offUID),
+		GID:                   r.u32(offGID),
+		PID:                   r.u32(offPID),
+		PPID:                  r.u32(offPPID),
+		BTime:                 r.u32(offBTime),
+		ETime:                 r.u64(offETime),
+		UTime:                 r.u64(offUTime),
+		STime:                 r.u64(offSTime),
+		MinFlt:                r.u64(offMinFlt),
+		MajFlt:                r.u64(offMajFlt),
+		Coremem:               r.u64(offCoremem),
+		Virtmem:               r.u64(offVirtmem),
+		HiwaterRSS:            r.u64(offHiwaterRSS),
+		HiwaterVM:             r.u64(offHiwaterVM),
+		ReadChar:              r.u64(offReadChar),
+		WriteChar:             r.u64(offWriteChar),
+		ReadSyscalls:          r.u64(offReadSyscalls),
+		WriteSyscalls:         r.u64(offWriteSyscalls),
+		ReadBytes:             r.u64(offReadBytes),
+		WriteBytes:            r.u64(offWriteBytes),
+		CancelledWriteBytes:   r.u64(offCancelledWriteBytes),
+		Nvcsw:                 r.u64(offNvcsw),
+		Nivcsw:                r.u64(offNivcsw),
+		UTimeScaled:           r.u64(offUTimeScaled),
+		STimeScaled:           r.u64(offSTimeScaled),
+		CPUScaledRunRealTotal: r.u64(offCPUScaledRunRealTotal),
+		FreepagesCount:        r.u64(offFreepagesCount),
+		FreepagesDelayTotal:   r.u64(offFreepagesDelayTotal),
+		ThrashingCount:        r.u64(offThrashingCount),
+		ThrashingDelayTotal:   r.u64(offThrashingDelayTotal),
+		BTime64:               r.u64(offBTime64),
+		CompactCount:          r.u64(offCompactCount),
+		CompactDelayTotal:     r.u64(offCompactDelayTotal),
+		TGID:                  r.u32(offTGID),
+		TGETime:               r.u64(offTGETime),
+		ExeDev:                r.u64(offExeDev),
+		ExeInode:              r.u64(offExeInode),
+		WpcopyCount:           r.u64(offWpcopyCount),
+		WpcopyDelayTotal:      r.u64(offWpcopyDelayTotal),
+		IRQCount:              r.u64(offIRQCount),
+		IRQDelayTotal:         r.u64(offIRQDelayTotal),
+	}, nil
+}
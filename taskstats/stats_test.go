@@ -0,0 +1,82 @@
+package taskstats
+
+import (
+	"strings"
+	"testing"
+)
+
+// layout returns the captured struct taskstats as sent by a kernel with struct version v and size bytes (or cut to size).
+func layout(t *testing.T, v uint16, size int) []byte {
+	st := append([]byte{}, fixture(t, "pid_reply")[fixtureStatsOff:]...)[:size]
+	if size >= offVersion+2 {
+		nativeEndian.PutUint16(st[offVersion:], v)
+	}
+	return st
+}
+
+func TestParseStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint16
+		size    int
+		has     []Feature // features the stats must have.
+		hasNot  []Feature // features the stats must not have.
+		start   uint64
+		tgid    uint32
+	}{
+		{"v8", 8, offThrashingCount, []Feature{Basic, Extended, IO, CtxSwitch, Scaled}, []Feature{BTime64, ThreadGroup}, 1792344951, 0},
+		{"v10", 10, offCompactCount, []Feature{Basic, IO, BTime64}, []Feature{ThreadGroup}, 1792344951, 0},
+		{"v14", 14, offIRQDelayTotal + 8, []Feature{Basic, IO, BTime64, ThreadGroup}, nil, 1792344951, 26370},
+		{"v16", 16, 560, []Feature{Basic, Extended, IO, BTime64, ThreadGroup}, nil, 1792344951, 26370},
+		// A struct cut in the command name: the fields beyond the buffer read as 0.
+		{"truncated", 16, offComm + 4, nil, []Feature{Basic, Extended, IO}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := ParseStats(layout(t, tt.version, tt.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Version != tt.version || st.Size != tt.size {
+				t.Errorf("version %d size %d, want %d %d", st.Version, st.Size, tt.version, tt.size)
+			}
+			for _, f := range tt.has {
+				if !st.Has(f) {
+					t.Errorf("no %s", f)
+				}
+			}
+			for _, f := range tt.hasNot {
+				if st.Has(f) {
+					t.Errorf("unexpected %s", f)
+				}
+			}
+			if st.StartTime() != tt.start || st.TGID != tt.tgid {
+				t.Errorf("start %d tgid %d, want %d %d", st.StartTime(), st.TGID, tt.start, tt.tgid)
+			}
+			if !st.Has(Basic) {
+				return
+			}
+			if st.Comm != "taskstats.test" || st.PID != 26370 || st.PPID != 26280 || st.STime != 4000 || st.ETime != 2502 {
+				t.Errorf("comm %q pid %d ppid %d stime %d etime %d", st.Comm, st.PID, st.PPID, st.STime, st.ETime)
+			}
+			if st.HiwaterRSS != 3712 || st.WriteBytes != 4096 {
+				t.Errorf("rss %d write bytes %d", st.HiwaterRSS, st.WriteBytes)
+			}
+		})
+	}
+}
+
+func TestParseStatsShort(t *testing.T) {
+	st, err := ParseStats(layout(t, 16, offComm+4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Comm != "task" || st.PID != 0 || st.BTime64 != 0 {
+		t.Errorf("comm %q pid %d btime64 %d, want the partial command only", st.Comm, st.PID, st.BTime64)
+	}
+	for _, n := range []int{0, 8, offComm - 1} {
+		if _, err := ParseStats(layout(t, 16, n)); err == nil || !strings.Contains(err.Error(), "too short") {
+			t.Errorf("%d bytes: error %v, want too short", n, err)
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"unsafe"
@@ -33,7 +35,7 @@ func getTermDimensions() (col, row uint) {
 }
 
 // display a separator with an insert.
-func printSep(f *os.File, format string, a ...interface{}) {
+func printSep(f io.Writer, format string, a ...interface{}) {
 	lm := 5 // left margin
 	sc := "-"
 	i := fmt.Sprintf(format, a...)
@@ -201,3 +203,164 @@ func kernelVersion() (string, error) {
 	}
 	return "", nil
 }
+
+// cpuBusyTime returns the busy time (user+nice+system+irq+softirq) summed over all CPUs since boot, in clock ticks.
+// Only the first line of /proc/stat (the "cpu" aggregate) is parsed. steal (time the hypervisor gave to other guests) is
+// not ours and guest is already in user.
+func cpuBusyTime() (uint64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var b [512]byte // The aggregate line is far shorter than this.
+	n, err := f.Read(b[:])
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	s := b[:n]
+	if n < 4 || string(s[0:4]) != "cpu " {
+		return 0, fmt.Errorf("unexpected /proc/stat format")
+	}
+	var busy uint64
+	i := 4
+	for f := 0; f < 7; f++ { // user nice system idle iowait irq softirq
+		for i < n && s[i] == ' ' {
+			i++
+		}
+		var v int64
+		v, i = fastParseInt(s, i)
+		switch f {
+		case 3, 4: // idle and iowait are not busy time.
+		default:
+			busy += uint64(v)
+		}
+	}
+	return busy, nil
+}
+
+// netlinkDrops returns the number of messages the kernel dropped for the netlink socket with the given inode (from /proc/net/netlink).
+func netlinkDrops(inode uint64) (uint64, error) {
+	b, err := ioutil.ReadFile("/proc/net/netlink")
+	if err != nil {
+		return 0, err
+	}
+	ino := strconv.FormatUint(inode, 10)
+	// sk Eth Pid Groups Rmem Wmem Dump Locks Drops Inode
+	for _, l := range strings.Split(string(b), "\n")[1:] {
+		f := strings.Fields(l)
+		if len(f) < 10 || f[9] != ino {
+			continue
+		}
+		return strconv.ParseUint(f[8], 10, 64)
+	}
+	return 0, fmt.Errorf("netlink socket %d not found", inode)
+}
+
+// userHZ returns USER_HZ, the clock ticks per second of the /proc counters, from the AT_CLKTCK entry of the auxiliary
+// vector the kernel gave us.
+func userHZ() (uint64, error) {
+	const atClkTck = 17
+	b, err := ioutil.ReadFile("/proc/self/auxv")
+	if err != nil {
+		return 0, err
+	}
+	w := int(unsafe.Sizeof(uintptr(0))) // The entries are pairs of native words.
+	word := func(b []byte) uint64 {
+		if w == 4 {
+			return uint64(binary.NativeEndian.Uint32(b))
+		}
+		return binary.NativeEndian.Uint64(b)
+	}
+	for i := 0; i+2*w <= len(b); i += 2 * w {
+		if word(b[i:]) == atClkTck {
+			if hz := word(b[i+w:]); hz != 0 {
+				return hz, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no AT_CLKTCK in /proc/self/auxv")
+}
+
+// readBootTime returns the system boot time [sec since 1970] (btime line of /proc/stat).
+func readBootTime() (uint64, error) {
+	b, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(l, "btime ") {
+			return strconv.ParseUint(strings.TrimSpace(l[6:]), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no btime in /proc/stat")
+}
+
+// possibleCPUs returns the cpus that may ever be online (from /sys/devices/system/cpu/possible).
+// runtime.NumCPU only counts the cpus of our affinity mask (taskset, cpuset cgroup).
+func possibleCPUs() ([]int, error) {
+	b, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// parseCPUList parses a kernel cpu list (eg: "0-3,8,10-11").
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, r := range strings.Split(s, ",") {
+		lo, hi := r, r
+		if i := strings.Index(r, "-"); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("bad cpu list '%s'", s)
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("bad cpu list '%s'", s)
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// cpuList formats increasing cpus as a kernel cpu list (eg: "0-3,8").
+func cpuList(cpus []int) string {
+	var a []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if j == i {
+			a = append(a, strconv.Itoa(cpus[i]))
+		} else {
+			a = append(a, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(a, ",")
+}
+
+// Clock ids of clock_gettime (linux/time.h).
+const (
+	clockMonotonic = 1
+	clockBoottime  = 7
+)
+
+// suspendedTime returns the time the system spent suspended since boot (CLOCK_BOOTTIME - CLOCK_MONOTONIC). [in ns]
+// The proc connector timestamps are CLOCK_MONOTONIC while btime and /proc/[pid]/stat start times count the suspends.
+func suspendedTime() uint64 {
+	var b, m syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockBoottime, uintptr(unsafe.Pointer(&b)), 0)
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&m)), 0)
+	if d := b.Nano() - m.Nano(); d > 0 {
+		return uint64(d)
+	}
+	return 0
+}
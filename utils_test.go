@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		s    string
+		cpus []int
+		list string // cpuList of cpus ("" for an error).
+	}{
+		{"0", []int{0}, "0"},
+		{"0-3", []int{0, 1, 2, 3}, "0-3"},
+		{"0-3,8,10-11", []int{0, 1, 2, 3, 8, 10, 11}, "0-3,8,10-11"},
+		{"2,3,4", []int{2, 3, 4}, "2-4"},
+		{"5-5", []int{5}, "5"},
+		{"3-1", nil, ""},
+		{"a", nil, ""},
+		{"1-", nil, ""},
+		{"0,,1", nil, ""},
+		{"", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			cpus, err := parseCPUList(tt.s)
+			if tt.list == "" {
+				if err == nil {
+					t.Errorf("%v, want an error", cpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cpus, tt.cpus) {
+				t.Errorf("%v, want %v", cpus, tt.cpus)
+			}
+			if l := cpuList(cpus); l != tt.list {
+				t.Errorf("cpuList %q, want %q", l, tt.list)
+			}
+		})
+	}
+}